@@ -0,0 +1,368 @@
+package pgperms
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Change is a typed description of a query, so library users can inspect what it does without parsing SQL.
+// Role names, privileges and the targets of privileges are written as they appear in the query. Database and schema names are unquoted.
+type Change interface {
+	// SQL returns the query that makes this change.
+	SQL() string
+}
+
+// ChangeSink is an optional extension of SyncSink. If the SyncSink given to Sync (or the Sync* functions) also implements ChangeSink, Change is called instead of Query.
+type ChangeSink interface {
+	SyncSink
+
+	// Change is called when a change should be made (in the given database) to get to the desired state.
+	// Like with Query, the database can be "", indicating it can be run on any database.
+	Change(database string, c Change)
+}
+
+// emit passes the change to ss, as a typed Change if ss supports it or as SQL otherwise.
+func emit(ss SyncSink, database string, c Change) {
+	if cs, ok := ss.(ChangeSink); ok {
+		cs.Change(database, c)
+		return
+	}
+	ss.Query(database, c.SQL())
+}
+
+// CreateRole creates a role with the given attributes.
+type CreateRole struct {
+	Name       string
+	Attributes RoleAttributes
+}
+
+func (c CreateRole) SQL() string {
+	return c.Attributes.CreateSQL(c.Name)
+}
+
+// AlterRole changes the attributes of a role. Fields that are nil aren't changed.
+type AlterRole struct {
+	Name string
+	// Password is the new (hashed) password. An empty string removes the password.
+	Password        *string
+	ConnectionLimit *int
+	// ValidUntil is the new expiry of the password. The zero time means it never expires.
+	ValidUntil  *time.Time
+	Superuser   *bool
+	Inherit     *bool
+	CreateRole  *bool
+	CreateDB    *bool
+	Login       *bool
+	Replication *bool
+	BypassRLS   *bool
+}
+
+func (c AlterRole) SQL() string {
+	q := "ALTER ROLE " + c.Name
+	if c.Password != nil {
+		if *c.Password == "" {
+			q += " PASSWORD NULL"
+		} else {
+			q += " PASSWORD " + Escape(*c.Password)
+		}
+	}
+	if c.ConnectionLimit != nil {
+		q += fmt.Sprintf(" CONNECTION LIMIT %d", *c.ConnectionLimit)
+	}
+	if c.ValidUntil != nil {
+		if c.ValidUntil.IsZero() {
+			q += " VALID UNTIL 'infinity'"
+		} else {
+			q += " VALID UNTIL " + Escape(c.ValidUntil.Format("2006-01-02T15:04:05Z"))
+		}
+	}
+	options := []struct {
+		name  string
+		value *bool
+	}{
+		{"SUPERUSER", c.Superuser},
+		{"INHERIT", c.Inherit},
+		{"CREATEROLE", c.CreateRole},
+		{"CREATEDB", c.CreateDB},
+		{"LOGIN", c.Login},
+		{"REPLICATION", c.Replication},
+		{"BYPASSRLS", c.BypassRLS},
+	}
+	for _, o := range options {
+		if o.value == nil {
+			continue
+		}
+		if *o.value {
+			q += " " + o.name
+		} else {
+			q += " NO" + o.name
+		}
+	}
+	return q
+}
+
+// DropRole drops a role.
+type DropRole struct {
+	Name string
+}
+
+func (c DropRole) SQL() string {
+	return "DROP ROLE " + c.Name
+}
+
+// SetRoleSetting sets a configuration parameter for a role, in every database if Database is empty.
+type SetRoleSetting struct {
+	Role     string
+	Database string
+	Name     string
+	Value    string
+}
+
+func (c SetRoleSetting) SQL() string {
+	return roleSettingPrefix(c.Role, c.Database) + " SET " + c.Name + " = " + settingValueSQL(c.Name, c.Value)
+}
+
+// ResetRoleSetting resets a configuration parameter for a role, in every database if Database is empty.
+type ResetRoleSetting struct {
+	Role     string
+	Database string
+	Name     string
+}
+
+func (c ResetRoleSetting) SQL() string {
+	return roleSettingPrefix(c.Role, c.Database) + " RESET " + c.Name
+}
+
+func roleSettingPrefix(role, database string) string {
+	prefix := "ALTER ROLE " + role
+	if database != "" {
+		prefix += " IN DATABASE " + safeIdentifier(database)
+	}
+	return prefix
+}
+
+// ReassignOwned gives all objects owned by Role (in the current database) to NewOwner.
+type ReassignOwned struct {
+	Role     string
+	NewOwner string
+}
+
+func (c ReassignOwned) SQL() string {
+	return "REASSIGN OWNED BY " + c.Role + " TO " + c.NewOwner
+}
+
+// DropOwned drops all objects owned by Role (in the current database) and revokes its privileges.
+type DropOwned struct {
+	Role string
+}
+
+func (c DropOwned) SQL() string {
+	return "DROP OWNED BY " + c.Role
+}
+
+// GrantMembership makes Member a member of Role, or adds options to an existing membership. Inherit and Set are only given if they're not nil.
+type GrantMembership struct {
+	Role    string
+	Member  string
+	Admin   bool
+	Inherit *bool
+	Set     *bool
+}
+
+func (c GrantMembership) SQL() string {
+	m := Membership{Role: c.Role, Admin: c.Admin, Inherit: c.Inherit, Set: c.Set}
+	return "GRANT " + c.Role + " TO " + c.Member + m.grantOptions()
+}
+
+// RevokeMembership removes Member from Role. If Option is set (ADMIN, INHERIT or SET), only that option is revoked.
+type RevokeMembership struct {
+	Role   string
+	Member string
+	Option string
+}
+
+func (c RevokeMembership) SQL() string {
+	if c.Option != "" {
+		return "REVOKE " + c.Option + " OPTION FOR " + c.Role + " FROM " + c.Member
+	}
+	return "REVOKE " + c.Role + " FROM " + c.Member
+}
+
+// GrantPrivilege grants privileges on objects of the given type (like TABLE or FOREIGN SERVER). If Columns is set, the privileges are granted on those columns of the tables.
+type GrantPrivilege struct {
+	ObjectType string
+	Privileges []string
+	Columns    []string
+	Targets    []string
+	Roles      []string
+	Grantable  bool
+}
+
+func (c GrantPrivilege) SQL() string {
+	q := "GRANT " + privilegeList(c.Privileges, c.Columns) + " ON " + c.ObjectType + " " + strings.Join(c.Targets, ", ") + " TO " + strings.Join(c.Roles, ", ")
+	if c.Grantable {
+		q += " WITH GRANT OPTION"
+	}
+	return q
+}
+
+// RevokePrivilege revokes privileges on objects of the given type. If GrantOptionOnly is set, only the grant option is revoked.
+type RevokePrivilege struct {
+	ObjectType      string
+	Privileges      []string
+	Columns         []string
+	Targets         []string
+	Roles           []string
+	GrantOptionOnly bool
+}
+
+func (c RevokePrivilege) SQL() string {
+	q := "REVOKE "
+	if c.GrantOptionOnly {
+		q += "GRANT OPTION FOR "
+	}
+	return q + privilegeList(c.Privileges, c.Columns) + " ON " + c.ObjectType + " " + strings.Join(c.Targets, ", ") + " FROM " + strings.Join(c.Roles, ", ")
+}
+
+func privilegeList(privileges, columns []string) string {
+	if len(columns) == 0 {
+		return strings.Join(privileges, ", ")
+	}
+	ret := make([]string, len(privileges))
+	for i, p := range privileges {
+		ret[i] = p + " (" + strings.Join(columns, ", ") + ")"
+	}
+	return strings.Join(ret, ", ")
+}
+
+// GrantDefaultPrivilege grants privileges on objects created by Owner in the future, optionally only in Schema. ObjectType is as in the config, like tables.
+type GrantDefaultPrivilege struct {
+	Owner      string
+	Schema     string
+	ObjectType string
+	Privileges []string
+	Roles      []string
+	Grantable  bool
+}
+
+func (c GrantDefaultPrivilege) SQL() string {
+	q := defaultPrivilegesPrefix(c.Owner, c.Schema) + " GRANT " + strings.Join(c.Privileges, ", ") + " ON " + strings.ToUpper(c.ObjectType) + " TO " + strings.Join(c.Roles, ", ")
+	if c.Grantable {
+		q += " WITH GRANT OPTION"
+	}
+	return q
+}
+
+// RevokeDefaultPrivilege revokes default privileges. If GrantOptionOnly is set, only the grant option is revoked.
+type RevokeDefaultPrivilege struct {
+	Owner           string
+	Schema          string
+	ObjectType      string
+	Privileges      []string
+	Roles           []string
+	GrantOptionOnly bool
+}
+
+func (c RevokeDefaultPrivilege) SQL() string {
+	q := defaultPrivilegesPrefix(c.Owner, c.Schema) + " REVOKE "
+	if c.GrantOptionOnly {
+		q += "GRANT OPTION FOR "
+	}
+	return q + strings.Join(c.Privileges, ", ") + " ON " + strings.ToUpper(c.ObjectType) + " FROM " + strings.Join(c.Roles, ", ")
+}
+
+func defaultPrivilegesPrefix(owner, schema string) string {
+	q := "ALTER DEFAULT PRIVILEGES FOR ROLE " + owner
+	if schema != "" {
+		q += " IN SCHEMA " + schema
+	}
+	return q
+}
+
+// CreateDatabase creates a database. The owner isn't set by this change.
+type CreateDatabase struct {
+	Database DatabaseDefinition
+}
+
+func (c CreateDatabase) SQL() string {
+	return c.Database.CreateSQL()
+}
+
+// AlterDatabase changes the attributes of a database. Fields that are nil aren't changed.
+type AlterDatabase struct {
+	Name             string
+	ConnectionLimit  *int
+	AllowConnections *bool
+	IsTemplate       *bool
+}
+
+func (c AlterDatabase) SQL() string {
+	q := "ALTER DATABASE " + safeIdentifier(c.Name)
+	if c.ConnectionLimit != nil {
+		q += " CONNECTION LIMIT " + strconv.Itoa(*c.ConnectionLimit)
+	}
+	if c.AllowConnections != nil {
+		q += " ALLOW_CONNECTIONS " + strconv.FormatBool(*c.AllowConnections)
+	}
+	if c.IsTemplate != nil {
+		q += " IS_TEMPLATE " + strconv.FormatBool(*c.IsTemplate)
+	}
+	return q
+}
+
+// DropDatabase drops a database. Force terminates the sessions connected to it, which needs PostgreSQL 13 or newer.
+type DropDatabase struct {
+	Name  string
+	Force bool
+}
+
+func (c DropDatabase) SQL() string {
+	if c.Force {
+		return "DROP DATABASE " + safeIdentifier(c.Name) + " WITH (FORCE)"
+	}
+	return "DROP DATABASE " + safeIdentifier(c.Name)
+}
+
+// TerminateSessions terminates all other sessions connected to a database.
+type TerminateSessions struct {
+	Database string
+}
+
+func (c TerminateSessions) SQL() string {
+	return "SELECT pg_terminate_backend(pid) FROM pg_catalog.pg_stat_activity WHERE datname = " + Escape(c.Database) + " AND pid != pg_backend_pid()"
+}
+
+// CreateSchema creates a schema in the current database, owned by Owner if it's set.
+type CreateSchema struct {
+	Name  string
+	Owner string
+}
+
+func (c CreateSchema) SQL() string {
+	if c.Owner != "" {
+		return "CREATE SCHEMA " + safeIdentifier(c.Name) + " AUTHORIZATION " + c.Owner
+	}
+	return "CREATE SCHEMA " + safeIdentifier(c.Name)
+}
+
+// DropSchema drops a schema in the current database.
+type DropSchema struct {
+	Name string
+}
+
+func (c DropSchema) SQL() string {
+	return "DROP SCHEMA " + safeIdentifier(c.Name)
+}
+
+// AlterOwner changes the owner of an object of the given type (DATABASE, SCHEMA, TABLE, SEQUENCE or ROUTINE). Object is written as it appears in the query.
+type AlterOwner struct {
+	ObjectType string
+	Object     string
+	Owner      string
+}
+
+func (c AlterOwner) SQL() string {
+	return "ALTER " + c.ObjectType + " " + c.Object + " OWNER TO " + c.Owner
+}
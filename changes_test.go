@@ -0,0 +1,80 @@
+package pgperms
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/samber/lo"
+)
+
+type changeRecorder struct {
+	Recorder
+	changes []Change
+}
+
+func (r *changeRecorder) Change(database string, c Change) {
+	r.changes = append(r.changes, c)
+	r.Query(database, c.SQL())
+}
+
+func TestChangeSink(t *testing.T) {
+	r := &changeRecorder{}
+	SyncRoles(r, map[string]RoleAttributes{
+		"admin": {
+			Superuser:        true,
+			Password:         new(string),
+			MemberOf:         []Membership{{Role: "staff", Admin: true}},
+			Settings:         map[string]string{"work_mem": "4MB", "statement_timeout": "1s"},
+			DatabaseSettings: map[string]map[string]string{"db2": {"work_mem": "4MB"}},
+		},
+		"old": {Password: new(string)},
+	}, map[string]RoleAttributes{
+		"admin": {
+			MemberOf:         []Membership{{Role: "staff"}},
+			Settings:         map[string]string{"work_mem": "8MB", "search_path": "app"},
+			DatabaseSettings: map[string]map[string]string{"db1": {"work_mem": "8MB"}},
+		},
+		"new": {Login: lo.ToPtr(true)},
+	}, []TombstonedRole{{Name: "old"}}, nil)
+	r.AddBarrier()
+	SyncDatabases(r, nil, []TombstonedDatabase{{Name: "preview", Force: true}}, []DatabaseDefinition{{Name: "preview"}}, 120000)
+	SyncPrivileges(r, []string{"db"}, nil, []GenericPrivilege{{Roles: []string{"new"}, Privileges: []string{"SELECT"}, Columns: []string{"db.public.t.(a, b)"}}})
+
+	wantChanges := []Change{
+		DropRole{Name: "old"},
+		AlterRole{Name: "admin", Superuser: lo.ToPtr(false)},
+		CreateRole{Name: "new", Attributes: RoleAttributes{Login: lo.ToPtr(true)}},
+		SetRoleSetting{Role: "admin", Name: "search_path", Value: "app"},
+		ResetRoleSetting{Role: "admin", Name: "statement_timeout"},
+		SetRoleSetting{Role: "admin", Name: "work_mem", Value: "8MB"},
+		SetRoleSetting{Role: "admin", Database: "db1", Name: "work_mem", Value: "8MB"},
+		ResetRoleSetting{Role: "admin", Database: "db2", Name: "work_mem"},
+		RevokeMembership{Role: "staff", Member: "admin", Option: "ADMIN"},
+		AlterDatabase{Name: "preview", AllowConnections: lo.ToPtr(false)},
+		TerminateSessions{Database: "preview"},
+		DropDatabase{Name: "preview"},
+		GrantPrivilege{ObjectType: "TABLE", Privileges: []string{"SELECT"}, Columns: []string{"a", "b"}, Targets: []string{"public.t"}, Roles: []string{"new"}},
+	}
+	if diff := cmp.Diff(wantChanges, r.changes, cmp.AllowUnexported(RoleAttributes{})); diff != "" {
+		t.Errorf("Sync* passed different changes (-want +got): %s", diff)
+	}
+
+	wantQueries := []QueryForDatabase{
+		{"", "ALTER ROLE admin NOSUPERUSER"},
+		{"", "CREATE ROLE new LOGIN"},
+		{"", "DROP ROLE old"},
+		{"", "ALTER ROLE admin IN DATABASE db1 SET work_mem = '8MB'"},
+		{"", "ALTER ROLE admin IN DATABASE db2 RESET work_mem"},
+		{"", "ALTER ROLE admin RESET statement_timeout"},
+		{"", "ALTER ROLE admin SET search_path = app"},
+		{"", "ALTER ROLE admin SET work_mem = '8MB'"},
+		{"", "REVOKE ADMIN OPTION FOR staff FROM admin"},
+		{"", "ALTER DATABASE preview ALLOW_CONNECTIONS false"},
+		{"", "SELECT pg_terminate_backend(pid) FROM pg_catalog.pg_stat_activity WHERE datname = 'preview' AND pid != pg_backend_pid()"},
+		{"", "DROP DATABASE preview"},
+		{"db", "GRANT SELECT (a, b) ON TABLE public.t TO new"},
+	}
+	if diff := cmp.Diff(wantQueries, r.Get()); diff != "" {
+		t.Errorf("Changes rendered different SQL (-want +got): %s", diff)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/SnoozeThis-org/pgperms"
+)
+
+const (
+	initialBackoff = time.Second
+	// configPollInterval is how often the agent checks whether the config file changed.
+	configPollInterval = 5 * time.Second
+)
+
+// errConnection is returned by reconcile when the connection to the server is broken.
+var errConnection = errors.New("lost connection to the server")
+
+// agent syncs the config file to the cluster every interval (with jitter) until ctx is cancelled.
+// It syncs right away when the config file changes. After connection errors it reconnects with exponential backoff, so it doesn't hammer the server during a failover.
+func agent(ctx context.Context, conns *pgperms.Connections, currentUser string) {
+	var backoff time.Duration
+	var lastConfig []byte
+	for {
+		desired, err := ioutil.ReadFile(*config)
+		if err != nil {
+			log.Printf("Failed to read from config file %q: %v", *config, err)
+			stats.recordError()
+		} else {
+			if lastConfig != nil && !bytes.Equal(desired, lastConfig) {
+				log.Printf("Config file %q changed, reloaded it", *config)
+			}
+			lastConfig = desired
+			err = reconcile(ctx, conns, desired, currentUser, backoff > 0)
+		}
+		wait := jittered(*interval)
+		switch {
+		case errors.Is(err, errConnection):
+			if backoff == 0 {
+				backoff = initialBackoff
+			} else {
+				backoff *= 2
+			}
+			if backoff > *interval {
+				backoff = *interval
+			}
+			wait = jittered(backoff)
+			log.Printf("%v, retrying in %s", err, wait.Round(time.Second))
+		case err != nil:
+			backoff = 0
+			log.Printf("Failed to sync: %v", err)
+		default:
+			backoff = 0
+		}
+		if !waitForChange(ctx, wait, lastConfig) {
+			return
+		}
+	}
+}
+
+// reconcile syncs the desired config to the cluster once. If reconnect is set, it first replaces the connections.
+func reconcile(ctx context.Context, conns *pgperms.Connections, desired []byte, currentUser string, reconnect bool) error {
+	if reconnect {
+		if err := conns.Reconnect(ctx); err != nil {
+			stats.recordError()
+			return fmt.Errorf("%w: %v", errConnection, err)
+		}
+		log.Printf("Reconnected to the server")
+	}
+	err := syncOnce(ctx, conns, desired, currentUser)
+	if err == nil {
+		return nil
+	}
+	stats.recordError()
+	if ctx.Err() == nil && conns.Ping(ctx) != nil {
+		return fmt.Errorf("%w: %v", errConnection, err)
+	}
+	return err
+}
+
+// syncOnce calculates and applies the queries needed to get to the desired config, refusing to make changes that violate the guardrails.
+func syncOnce(ctx context.Context, conns *pgperms.Connections, desired []byte, currentUser string) error {
+	plan, err := pgperms.MakePlan(ctx, conns, desired, guardrails(currentUser))
+	if plan != nil {
+		// Export the pending queries right away, so they're visible even if the plan is refused or applying it fails.
+		stats.recordPending(plan.Operations)
+	}
+	if err != nil {
+		return err
+	}
+	if len(plan.Operations) == 0 {
+		stats.recordSuccess(desired, nil)
+		return nil
+	}
+	for _, q := range plan.Operations {
+		log.Printf("Executing %s", q.String())
+	}
+	rec := plan.Recorder()
+	if *transaction {
+		_, err = rec.ApplyTransactional(ctx, conns)
+	} else {
+		err = rec.Apply(ctx, conns)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Executed %d queries", len(plan.Operations))
+	stats.recordSuccess(desired, nil)
+	return nil
+}
+
+// jittered returns d randomly varied by the fraction given with --jitter. The fraction is checked to be in [0, 1) at startup, so the result is always positive.
+func jittered(d time.Duration) time.Duration {
+	return d + time.Duration((rand.Float64()*2-1)**jitter*float64(d))
+}
+
+// waitForChange waits for the given duration, or until the config file no longer has the given contents. It returns false if ctx was cancelled.
+func waitForChange(ctx context.Context, wait time.Duration, contents []byte) bool {
+	deadline := time.After(wait)
+	poll := time.NewTicker(configPollInterval)
+	defer poll.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-deadline:
+			return true
+		case <-poll.C:
+			b, err := ioutil.ReadFile(*config)
+			if err != nil {
+				if !os.IsNotExist(err) {
+					log.Printf("Failed to read from config file %q: %v", *config, err)
+				}
+				continue
+			}
+			if !bytes.Equal(b, contents) {
+				return true
+			}
+		}
+	}
+}
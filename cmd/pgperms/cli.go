@@ -2,11 +2,16 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/SnoozeThis-org/pgperms"
 	"github.com/creachadair/getpass"
@@ -17,15 +22,24 @@ import (
 var (
 	defaultConfig, _ = pgx.ParseConfig("")
 
-	config      = pflag.StringP("config", "c", "pgperms.yaml", "Path to the pgperms yaml config file")
-	dump        = pflag.Bool("dump", false, "Whether to dump the current permissions")
-	apply       = pflag.Bool("apply", false, "Whether to actually apply the needed queries")
-	showVersion = pflag.Bool("version", false, "Dump the version and exit")
-	host        = pflag.StringP("host", "h", defaultConfig.Host, "database server host or socket directory")
-	port        = pflag.IntP("port", "P", int(defaultConfig.Port), "database server port")
-	username    = pflag.StringP("username", "U", defaultConfig.User, "database user name")
-	askPassword = pflag.BoolP("password", "W", false, "prompt for password")
-	database    = pflag.StringP("database", "d", "postgres", "database name for initial connection")
+	config           = pflag.StringP("config", "c", "pgperms.yaml", "Path to the pgperms yaml config file")
+	dump             = pflag.Bool("dump", false, "Whether to dump the current permissions")
+	apply            = pflag.Bool("apply", false, "Whether to actually apply the needed queries")
+	planFile         = pflag.StringP("out", "o", "", "With pgperms plan, the file to write the plan to")
+	rollback         = pflag.String("rollback", "", "Write a psql script that undoes the changes to this file")
+	output           = pflag.String("output", "text", "Format to print the queries in: text or json")
+	allowDestructive = pflag.Bool("allow-destructive", false, "Allow dropping databases and schemas, DROP OWNED for tombstoned roles, revoking SUPERUSER or memberships from the connecting role and revoking more than --max-revokes privileges")
+	maxRevokes       = pflag.Int("max-revokes", 100, "Maximum number of privileges to revoke without --allow-destructive, or -1 for no limit")
+	interval         = pflag.Duration("interval", 5*time.Minute, "With pgperms watch or agent, how often to check the cluster")
+	jitter           = pflag.Float64("jitter", 0.1, "With pgperms agent, the fraction of --interval by which to randomly vary it")
+	metricsListen    = pflag.String("metrics-listen", "", "With pgperms watch or agent, the address to serve Prometheus metrics on /metrics, like :9187")
+	transaction      = pflag.Bool("transactional", false, "With --apply, run the queries for each database inside a transaction")
+	showVersion      = pflag.Bool("version", false, "Dump the version and exit")
+	host             = pflag.StringP("host", "h", defaultConfig.Host, "database server host or socket directory")
+	port             = pflag.IntP("port", "P", int(defaultConfig.Port), "database server port")
+	username         = pflag.StringP("username", "U", defaultConfig.User, "database user name")
+	askPassword      = pflag.BoolP("password", "W", false, "prompt for password")
+	database         = pflag.StringP("database", "d", "postgres", "database name for initial connection")
 
 	// Injected by releaser
 	version string
@@ -41,6 +55,12 @@ func main() {
 		}
 		return
 	}
+	if *output != "text" && *output != "json" {
+		log.Fatalf("--output should be text or json, not %q", *output)
+	}
+	if *jitter < 0 || *jitter >= 1 {
+		log.Fatalf("--jitter should be at least 0 and less than 1, not %g", *jitter)
+	}
 	ctx := context.Background()
 	dsn := fmt.Sprintf("host=%s port=%d user=%s dbname=%s", escapeDSNString(*host), *port, escapeDSNString(*username), escapeDSNString(*database))
 	if *askPassword {
@@ -62,6 +82,67 @@ func main() {
 		fmt.Println(ret)
 		return
 	}
+	conns := pgperms.NewConnections(ctx, conn)
+	defer conns.Close()
+	switch args := pflag.Args(); {
+	case len(args) == 0:
+		plan := makePlan(ctx, conns, conn.Config().User, *apply)
+		writeRollback(plan)
+		if !*apply {
+			printQueries(plan.Operations)
+			return
+		}
+		applyQueries(ctx, conns, plan.Recorder())
+	case args[0] == "plan" && len(args) == 1:
+		if *planFile == "" {
+			log.Fatalf("pgperms plan needs -o to know where to write the plan")
+		}
+		plan := makePlan(ctx, conns, conn.Config().User, true)
+		b, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			log.Fatalf("Failed to encode plan: %v", err)
+		}
+		if err := ioutil.WriteFile(*planFile, b, 0600); err != nil {
+			log.Fatalf("Failed to write plan to %q: %v", *planFile, err)
+		}
+		writeRollback(plan)
+		printQueries(plan.Operations)
+	case args[0] == "apply" && len(args) == 2:
+		b, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			log.Fatalf("Failed to read plan from %q: %v", args[1], err)
+		}
+		var plan pgperms.Plan
+		if err := json.Unmarshal(b, &plan); err != nil {
+			log.Fatalf("Failed to parse plan from %q: %v", args[1], err)
+		}
+		if err := plan.CheckFresh(ctx, conns); err != nil {
+			log.Fatalf("Refusing to apply plan %q: %v", args[1], err)
+		}
+		writeRollback(&plan)
+		applyQueries(ctx, conns, plan.Recorder())
+	case args[0] == "watch" && len(args) == 1:
+		readConfig() // Fail early if the config file can't be read.
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if *metricsListen != "" {
+			serveMetrics(*metricsListen, conns)
+		}
+		watch(ctx, conns, *interval)
+	case args[0] == "agent" && len(args) == 1:
+		readConfig() // Fail early if the config file can't be read.
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if *metricsListen != "" {
+			serveMetrics(*metricsListen, conns)
+		}
+		agent(ctx, conns, conn.Config().User)
+	default:
+		log.Fatalf("Usage: pgperms [flags], pgperms plan -o plan.json [flags], pgperms apply plan.json [flags], pgperms watch [--interval 5m] [flags] or pgperms agent [--interval 5m] [flags]")
+	}
+}
+
+func readConfig() []byte {
 	if *config == "" {
 		log.Fatalf("Unless --dump is specified, --config must be set")
 	}
@@ -69,25 +150,117 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to read from config file %q: %v", *config, err)
 	}
-	conns := pgperms.NewConnections(ctx, conn)
-	rec := pgperms.NewRecorder()
-	if err := pgperms.Sync(ctx, conns, desired, rec); err != nil {
+	return desired
+}
+
+// makePlan calculates the queries needed to sync the config file. Unless --allow-destructive is given, it prints how the plan violates the guardrails.
+// If refuse is set (because the plan is going to be applied), such plans are refused. Otherwise the plan is returned, so it can be reviewed.
+func makePlan(ctx context.Context, conns *pgperms.Connections, currentUser string, refuse bool) *pgperms.Plan {
+	plan, err := pgperms.MakePlan(ctx, conns, readConfig(), guardrails(currentUser))
+	var gerr *pgperms.GuardrailError
+	if errors.As(err, &gerr) {
+		for _, v := range gerr.Violations {
+			fmt.Fprintf(os.Stderr, "The plan %s\n", v)
+		}
+		if refuse {
+			log.Fatalf("Refusing to continue without --allow-destructive")
+		}
+		fmt.Fprintf(os.Stderr, "Applying this plan needs --allow-destructive\n\n")
+		return plan
+	}
+	if err != nil {
 		log.Fatalf("Failed to calculate queries needed to sync: %v", err)
 	}
-	if !*apply {
-		qs := rec.Get()
-		if len(qs) == 0 {
-			return // Exit 0
+	return plan
+}
+
+// guardrails returns the guardrails configured with the flags, or nil if --allow-destructive is given.
+func guardrails(currentUser string) *pgperms.Guardrails {
+	if *allowDestructive {
+		return nil
+	}
+	return &pgperms.Guardrails{
+		CurrentUser: currentUser,
+		MaxRevokes:  *maxRevokes,
+	}
+}
+
+// writeRollback writes the rollback script of the plan to the file given with --rollback, if any.
+func writeRollback(plan *pgperms.Plan) {
+	if *rollback == "" {
+		return
+	}
+	if err := ioutil.WriteFile(*rollback, []byte(plan.RollbackScript()), 0600); err != nil {
+		log.Fatalf("Failed to write rollback script to %q: %v", *rollback, err)
+	}
+	for _, s := range plan.Irreversible {
+		fmt.Fprintf(os.Stderr, "WARNING: Can't be rolled back: %s\n", s)
+	}
+}
+
+// printQueries prints the queries that would be executed in the format from --output, with a warning for destructive ones in text mode. It exits with status 9 if there are any queries.
+func printQueries(qs []pgperms.Operation) {
+	if *output == "json" {
+		// Print an empty list rather than null if there's nothing to do.
+		b, err := json.MarshalIndent(append([]pgperms.Operation{}, qs...), "", "  ")
+		if err != nil {
+			log.Fatalf("Failed to encode queries: %v", err)
+		}
+		fmt.Println(string(b))
+		if len(qs) > 0 {
+			os.Exit(9)
+		}
+		return
+	}
+	if len(qs) == 0 {
+		return // Exit 0
+	}
+	var drops []pgperms.Operation
+	for _, q := range qs {
+		if q.Destructive {
+			drops = append(drops, q)
 		}
-		for _, q := range qs {
-			fmt.Println(q.String())
+	}
+	if len(drops) > 0 {
+		fmt.Fprintf(os.Stderr, "WARNING: Applying this plan will drop %d object(s):\n", len(drops))
+		for _, q := range drops {
+			fmt.Fprintf(os.Stderr, "  %s\n", q.String())
 		}
-		os.Exit(9)
+		fmt.Fprintln(os.Stderr)
+	}
+	for _, q := range qs {
+		fmt.Println(q.String())
 	}
-	if err := rec.Apply(ctx, conns); err != nil {
+	os.Exit(9)
+}
+
+func applyQueries(ctx context.Context, conns *pgperms.Connections, rec *pgperms.Recorder) {
+	if !*transaction {
+		if err := rec.Apply(ctx, conns); err != nil {
+			log.Fatalf("Failed to synchronize: %v", err)
+		}
+		return
+	}
+	results, err := rec.ApplyTransactional(ctx, conns)
+	for _, r := range results {
+		db := r.Database
+		if db == "" {
+			db = "(any)"
+		}
+		switch {
+		case !r.Committed && !r.Transactional:
+			fmt.Fprintf(os.Stderr, "Failed to execute the queries that can't run in a transaction (these can't be rolled back)\n")
+		case !r.Committed:
+			fmt.Fprintf(os.Stderr, "Rolled back %d queries on database %s\n", len(r.Queries), db)
+		case !r.Transactional:
+			fmt.Fprintf(os.Stderr, "Executed %d queries that can't run in a transaction\n", len(r.Queries))
+		default:
+			fmt.Fprintf(os.Stderr, "Committed %d queries on database %s\n", len(r.Queries), db)
+		}
+	}
+	if err != nil {
 		log.Fatalf("Failed to synchronize: %v", err)
 	}
-	conns.Close()
 }
 
 func escapeDSNString(s string) string {
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SnoozeThis-org/pgperms"
+	"gopkg.in/yaml.v3"
+)
+
+// metrics are exported in the Prometheus text format on /metrics, when --metrics-listen is given.
+type metrics struct {
+	mu sync.Mutex
+	// pending is the number of queries needed to sync, keyed by kind and database.
+	pending         map[[2]string]int
+	lastSuccess     time.Time
+	errors          int
+	gatherDurations map[string]time.Duration
+	managedRoles    int
+	tombstonedRoles int
+}
+
+var stats = &metrics{
+	pending:         map[[2]string]int{},
+	gatherDurations: map[string]time.Duration{},
+}
+
+// serveMetrics starts serving /metrics on the given address in the background, and makes conns report gather durations.
+func serveMetrics(addr string, conns *pgperms.Connections) {
+	conns.OnGather(stats.recordGather)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", stats)
+	go func() {
+		log.Fatalf("Failed to serve metrics on %q: %v", addr, http.ListenAndServe(addr, mux))
+	}()
+}
+
+func (m *metrics) recordGather(database string, took time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gatherDurations[database] = took
+}
+
+// recordPending records the queries that are needed to sync the cluster to the config file, even if they won't be applied (like when the plan is refused).
+func (m *metrics) recordPending(qs []pgperms.Operation) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending = map[[2]string]int{}
+	for _, q := range qs {
+		m.pending[[2]string{q.Kind, q.Database}]++
+	}
+}
+
+// recordSuccess records a successful sync (or drift check), after which the given queries are still needed to sync the cluster to the config file.
+func (m *metrics) recordSuccess(desired []byte, qs []pgperms.Operation) {
+	var c pgperms.Config
+	if err := yaml.Unmarshal(desired, &c); err != nil {
+		// Sync already succeeded on this config, so this shouldn't happen.
+		log.Printf("Failed to parse config file for metrics: %v", err)
+	}
+	m.recordPending(qs)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastSuccess = time.Now()
+	m.managedRoles = len(c.Roles)
+	m.tombstonedRoles = len(c.TombstonedRoles)
+}
+
+func (m *metrics) recordError() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors++
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP pgperms_pending_queries Number of queries needed to sync the cluster to the config file.")
+	fmt.Fprintln(w, "# TYPE pgperms_pending_queries gauge")
+	keys := make([][2]string, 0, len(m.pending))
+	for k := range m.pending {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] == keys[j][0] {
+			return keys[i][1] < keys[j][1]
+		}
+		return keys[i][0] < keys[j][0]
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "pgperms_pending_queries{kind=%s,database=%s} %d\n", labelValue(k[0]), labelValue(k[1]), m.pending[k])
+	}
+
+	fmt.Fprintln(w, "# HELP pgperms_last_success_timestamp_seconds Time of the last successful sync (or drift check).")
+	fmt.Fprintln(w, "# TYPE pgperms_last_success_timestamp_seconds gauge")
+	if !m.lastSuccess.IsZero() {
+		fmt.Fprintf(w, "pgperms_last_success_timestamp_seconds %d\n", m.lastSuccess.Unix())
+	}
+
+	fmt.Fprintln(w, "# HELP pgperms_errors_total Number of syncs (or drift checks) that failed.")
+	fmt.Fprintln(w, "# TYPE pgperms_errors_total counter")
+	fmt.Fprintf(w, "pgperms_errors_total %d\n", m.errors)
+
+	fmt.Fprintln(w, "# HELP pgperms_gather_duration_seconds How long gathering the state of a database took the last time.")
+	fmt.Fprintln(w, "# TYPE pgperms_gather_duration_seconds gauge")
+	databases := make([]string, 0, len(m.gatherDurations))
+	for db := range m.gatherDurations {
+		databases = append(databases, db)
+	}
+	sort.Strings(databases)
+	for _, db := range databases {
+		fmt.Fprintf(w, "pgperms_gather_duration_seconds{database=%s} %g\n", labelValue(db), m.gatherDurations[db].Seconds())
+	}
+
+	fmt.Fprintln(w, "# HELP pgperms_managed_roles Number of roles in the config file.")
+	fmt.Fprintln(w, "# TYPE pgperms_managed_roles gauge")
+	fmt.Fprintf(w, "pgperms_managed_roles %d\n", m.managedRoles)
+	fmt.Fprintln(w, "# HELP pgperms_tombstoned_roles Number of tombstoned roles in the config file.")
+	fmt.Fprintln(w, "# TYPE pgperms_tombstoned_roles gauge")
+	fmt.Fprintf(w, "pgperms_tombstoned_roles %d\n", m.tombstonedRoles)
+}
+
+// labelValue quotes a label value for the Prometheus text format.
+func labelValue(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
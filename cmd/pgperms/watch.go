@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/SnoozeThis-org/pgperms"
+)
+
+// driftReport is printed with --output json whenever the drift changes.
+type driftReport struct {
+	Time     time.Time           `json:"time"`
+	Pending  int                 `json:"pending"`
+	Added    []pgperms.Operation `json:"added"`
+	Resolved []pgperms.Operation `json:"resolved"`
+}
+
+// watch calculates the queries needed to sync the config file every interval, and reports whenever they change. It never applies them.
+// The config file is read again every time, so it can be changed while watching.
+func watch(ctx context.Context, conns *pgperms.Connections, interval time.Duration) {
+	var previous []pgperms.Operation
+	first := true
+	for {
+		desired, qs, err := drift(ctx, conns)
+		if err != nil {
+			log.Printf("Failed to check for drift: %v", err)
+			stats.recordError()
+		} else {
+			stats.recordSuccess(desired, qs)
+			added, resolved := diffQueries(previous, qs)
+			if first || len(added) > 0 || len(resolved) > 0 {
+				reportDrift(qs, added, resolved)
+			}
+			previous = qs
+			first = false
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// drift reads the config file and returns it with the queries needed to get from the current state of the cluster to the config.
+func drift(ctx context.Context, conns *pgperms.Connections) ([]byte, []pgperms.Operation, error) {
+	desired, err := ioutil.ReadFile(*config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read from config file %q: %v", *config, err)
+	}
+	rec := pgperms.NewRecorder()
+	if err := pgperms.Sync(ctx, conns, desired, rec); err != nil {
+		return nil, nil, err
+	}
+	return desired, rec.Operations(), nil
+}
+
+// diffQueries returns the queries that are in qs but not in previous, and the other way around.
+// Queries are compared by their stable form, so that the same changes aren't reported again just because a password was hashed with a new salt.
+func diffQueries(previous, qs []pgperms.Operation) (added, resolved []pgperms.Operation) {
+	seen := map[string]bool{}
+	for _, q := range previous {
+		seen[q.StableString()] = true
+	}
+	for _, q := range qs {
+		if !seen[q.StableString()] {
+			added = append(added, q)
+		}
+		delete(seen, q.StableString())
+	}
+	for _, q := range previous {
+		if seen[q.StableString()] {
+			resolved = append(resolved, q)
+		}
+	}
+	return added, resolved
+}
+
+func reportDrift(qs, added, resolved []pgperms.Operation) {
+	if *output == "json" {
+		r := driftReport{
+			Time:     time.Now(),
+			Pending:  len(qs),
+			Added:    append([]pgperms.Operation{}, added...),
+			Resolved: append([]pgperms.Operation{}, resolved...),
+		}
+		b, err := json.Marshal(r)
+		if err != nil {
+			log.Fatalf("Failed to encode drift: %v", err)
+		}
+		fmt.Println(string(b))
+		return
+	}
+	if len(qs) == 0 {
+		log.Printf("No drift: the cluster matches the config")
+	} else {
+		log.Printf("Drift changed: %d queries are needed to sync the cluster", len(qs))
+	}
+	for _, q := range added {
+		fmt.Fprintf(os.Stderr, "  + %s\n", q.StableString())
+	}
+	for _, q := range resolved {
+		fmt.Fprintf(os.Stderr, "  - %s\n", q.StableString())
+	}
+}
@@ -3,6 +3,7 @@ package pgperms
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/jackc/pgx/v4"
 )
@@ -13,6 +14,8 @@ type Connections struct {
 	primary     *pgx.Conn
 	perDatabase map[string]*pgx.Conn
 	refcounts   map[string]int
+
+	onGather func(database string, took time.Duration)
 }
 
 // NewConnections creates a new set of connections, starting with given connection as the primary connection.
@@ -43,8 +46,12 @@ func (c *Connections) Get(database string) (*pgx.Conn, func(), error) {
 		}
 	}
 	if conn, ok := c.perDatabase[database]; ok {
-		c.refcounts[database]++
-		return conn, deref, nil
+		if !conn.IsClosed() || c.refcounts[database] > 0 || conn == c.primary {
+			c.refcounts[database]++
+			return conn, deref, nil
+		}
+		// The connection was broken (like during a failover). Connect again.
+		c.DropCachedConnection(database)
 	}
 	cc := c.primary.Config()
 	cc.Database = database
@@ -57,6 +64,11 @@ func (c *Connections) Get(database string) (*pgx.Conn, func(), error) {
 	return dbconn, deref, nil
 }
 
+// OnGather sets a function that's called by Gather after it has gathered the state of each database, with how long that took.
+func (c *Connections) OnGather(f func(database string, took time.Duration)) {
+	c.onGather = f
+}
+
 // DropCachedConnection disconnects from the given database name if needed.
 func (c *Connections) DropCachedConnection(database string) {
 	conn, ok := c.perDatabase[database]
@@ -71,6 +83,42 @@ func (c *Connections) DropCachedConnection(database string) {
 	delete(c.refcounts, database)
 }
 
+// dropIdleConnections disconnects from all databases except the primary that aren't in use.
+func (c *Connections) dropIdleConnections() {
+	for name, conn := range c.perDatabase {
+		if conn != c.primary && c.refcounts[name] == 0 {
+			c.DropCachedConnection(name)
+		}
+	}
+}
+
+// Ping checks whether the primary connection still works.
+func (c *Connections) Ping(ctx context.Context) error {
+	return c.primary.Ping(ctx)
+}
+
+// Reconnect replaces all connections, including the primary, with new ones using the same config. This is useful after the server restarted or failed over.
+// None of the connections may be in use.
+func (c *Connections) Reconnect(ctx context.Context) error {
+	cc := c.primary.Config()
+	primary, err := pgx.ConnectConfig(ctx, cc)
+	if err != nil {
+		return err
+	}
+	for name, conn := range c.perDatabase {
+		if c.refcounts[name] > 0 {
+			panic(fmt.Errorf("Connection to database %q is still in use", name))
+		}
+		_ = conn.Close(c.ctx)
+	}
+	c.primary = primary
+	c.perDatabase = map[string]*pgx.Conn{
+		cc.Database: primary,
+	}
+	c.refcounts = map[string]int{}
+	return nil
+}
+
 // Close all connections except for the primary.
 func (c *Connections) Close() {
 	for name, conn := range c.perDatabase {
@@ -80,3 +128,12 @@ func (c *Connections) Close() {
 		c.DropCachedConnection(name)
 	}
 }
+
+// serverVersion returns the version of the PostgreSQL server as a number, like 160002 for 16.2.
+func serverVersion(ctx context.Context, conn *pgx.Conn) (int, error) {
+	var version int
+	if err := conn.QueryRow(ctx, "SELECT current_setting('server_version_num')::int").Scan(&version); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
@@ -2,88 +2,367 @@ package pgperms
 
 import (
 	"context"
+	"path"
+	"sort"
+	"strconv"
 
 	"github.com/jackc/pgx/v4"
+	"github.com/samber/lo"
+	"gopkg.in/yaml.v3"
 )
 
-// fetchDatabases returns a list of databases existing in the cluster.
-func fetchDatabases(ctx context.Context, conn *pgx.Conn) ([]string, error) {
-	rows, err := conn.Query(ctx, "SELECT datname FROM pg_catalog.pg_database WHERE datallowconn")
+// DatabaseDefinition describes a database in the config. It can be written as just the name or as an object.
+// Template, Encoding, LcCollate and LcCtype are only used when creating the database. The other fields are also changed for existing databases. Fields that aren't set are left alone.
+type DatabaseDefinition struct {
+	Name             string `yaml:"name"`
+	Owner            string `yaml:"owner,omitempty"`
+	Template         string `yaml:"template,omitempty"`
+	Encoding         string `yaml:"encoding,omitempty"`
+	LcCollate        string `yaml:"lc_collate,omitempty"`
+	LcCtype          string `yaml:"lc_ctype,omitempty"`
+	ConnectionLimit  *int   `yaml:"connection_limit,omitempty"`
+	AllowConnections *bool  `yaml:"allow_connections,omitempty"`
+	IsTemplate       *bool  `yaml:"is_template,omitempty"`
+}
+
+func (d DatabaseDefinition) GetConnectionLimit() int {
+	if d.ConnectionLimit == nil {
+		return -1
+	}
+	return *d.ConnectionLimit
+}
+
+func (d DatabaseDefinition) GetAllowConnections() bool {
+	return d.AllowConnections == nil || *d.AllowConnections
+}
+
+func (d DatabaseDefinition) GetIsTemplate() bool {
+	return d.IsTemplate != nil && *d.IsTemplate
+}
+
+// CreateSQL returns the SQL to create this database.
+// The owner is set afterwards by SyncDatabaseAttributes, because the role might not exist yet.
+func (d DatabaseDefinition) CreateSQL() string {
+	q := "CREATE DATABASE " + safeIdentifier(d.Name)
+	if d.Template != "" {
+		q += " TEMPLATE " + safeIdentifier(d.Template)
+	}
+	if d.Encoding != "" {
+		q += " ENCODING " + Escape(d.Encoding)
+	}
+	if d.LcCollate != "" {
+		q += " LC_COLLATE " + Escape(d.LcCollate)
+	}
+	if d.LcCtype != "" {
+		q += " LC_CTYPE " + Escape(d.LcCtype)
+	}
+	if d.ConnectionLimit != nil {
+		q += " CONNECTION LIMIT " + strconv.Itoa(*d.ConnectionLimit)
+	}
+	return q
+}
+
+type plainDatabaseDefinition DatabaseDefinition
+
+func (d *DatabaseDefinition) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*d = DatabaseDefinition{Name: value.Value}
+		return nil
+	}
+	return decodeStrict(value, (*plainDatabaseDefinition)(d))
+}
+
+func (d DatabaseDefinition) MarshalYAML() (interface{}, error) {
+	if d == (DatabaseDefinition{Name: d.Name}) {
+		return d.Name, nil
+	}
+	return plainDatabaseDefinition(d), nil
+}
+
+// SchemaDefinition describes a schema in the config. It can be written as just the name (database.schema) or as an object.
+type SchemaDefinition struct {
+	Name  string `yaml:"name"`
+	Owner string `yaml:"owner,omitempty"`
+}
+
+type plainSchemaDefinition SchemaDefinition
+
+func (s *SchemaDefinition) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*s = SchemaDefinition{Name: value.Value}
+		return nil
+	}
+	return decodeStrict(value, (*plainSchemaDefinition)(s))
+}
+
+func (s SchemaDefinition) MarshalYAML() (interface{}, error) {
+	if s == (SchemaDefinition{Name: s.Name}) {
+		return s.Name, nil
+	}
+	return plainSchemaDefinition(s), nil
+}
+
+// TombstonedDatabase is a database that should be dropped. It can be written as just the name or as an object.
+type TombstonedDatabase struct {
+	Name string `yaml:"name"`
+	// Force terminates all sessions connected to the database, so dropping it doesn't fail.
+	Force bool `yaml:"force,omitempty"`
+}
+
+type plainTombstonedDatabase TombstonedDatabase
+
+func (t *TombstonedDatabase) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*t = TombstonedDatabase{Name: value.Value}
+		return nil
+	}
+	return decodeStrict(value, (*plainTombstonedDatabase)(t))
+}
+
+func (t TombstonedDatabase) MarshalYAML() (interface{}, error) {
+	if !t.Force {
+		return t.Name, nil
+	}
+	return plainTombstonedDatabase(t), nil
+}
+
+func tombstonedDatabaseNames(tombstoned []TombstonedDatabase) []string {
+	ret := make([]string, len(tombstoned))
+	for i, t := range tombstoned {
+		ret[i] = t.Name
+	}
+	return ret
+}
+
+func databaseNames(dbs []DatabaseDefinition) []string {
+	ret := make([]string, len(dbs))
+	for i, d := range dbs {
+		ret[i] = d.Name
+	}
+	return ret
+}
+
+// connectableDatabaseNames returns the names of the databases that allow connections.
+func connectableDatabaseNames(dbs []DatabaseDefinition) []string {
+	var ret []string
+	for _, d := range dbs {
+		if d.GetAllowConnections() {
+			ret = append(ret, d.Name)
+		}
+	}
+	return ret
+}
+
+// reassignableDatabaseNames returns the databases that allow connections, except for templates.
+// REASSIGN OWNED and DROP OWNED aren't run in templates, because a lingering connection to a template makes CREATE DATABASE fail.
+func reassignableDatabaseNames(dbs []DatabaseDefinition) []string {
+	var ret []string
+	for _, d := range dbs {
+		if d.GetAllowConnections() && !d.GetIsTemplate() {
+			ret = append(ret, d.Name)
+		}
+	}
+	return ret
+}
+
+func schemaNames(schemas []SchemaDefinition) []string {
+	ret := make([]string, len(schemas))
+	for i, s := range schemas {
+		ret[i] = s.Name
+	}
+	return ret
+}
+
+// fetchDatabases returns a list of databases existing in the cluster. template0 is skipped, because it can't be changed anyway.
+// Connection limit, allow_connections and is_template are only filled in if they differ from the default, to keep dumps small.
+func fetchDatabases(ctx context.Context, conn *pgx.Conn) ([]DatabaseDefinition, error) {
+	rows, err := conn.Query(ctx, "SELECT datname, pg_get_userbyid(datdba), datconnlimit, datallowconn, datistemplate FROM pg_catalog.pg_database WHERE datname != 'template0'")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var names []string
+	var dbs []DatabaseDefinition
 	for rows.Next() {
-		var database string
-		if err := rows.Scan(&database); err != nil {
+		var d DatabaseDefinition
+		var connLimit int
+		var allowConn, isTemplate bool
+		if err := rows.Scan(&d.Name, &d.Owner, &connLimit, &allowConn, &isTemplate); err != nil {
 			return nil, err
 		}
-		names = append(names, database)
+		if connLimit != -1 {
+			d.ConnectionLimit = &connLimit
+		}
+		if !allowConn {
+			d.AllowConnections = &allowConn
+		}
+		if isTemplate {
+			d.IsTemplate = &isTemplate
+		}
+		dbs = append(dbs, d)
 	}
-	return names, nil
+	return dbs, nil
 }
 
 // fetchSchemas returns a list of schemas existing in the database. The given connections need to be connected to the matching database.
-func fetchSchemas(ctx context.Context, conn *pgx.Conn, database string) ([]string, error) {
-	rows, err := conn.Query(ctx, "SELECT nspname FROM pg_catalog.pg_namespace WHERE nspname NOT IN ('pg_catalog', 'information_schema', 'pg_toast') AND nspname NOT LIKE 'pg_temp_%' AND nspname NOT LIKE 'pg_toast_temp_%'")
+func fetchSchemas(ctx context.Context, conn *pgx.Conn, database string) ([]SchemaDefinition, error) {
+	rows, err := conn.Query(ctx, "SELECT nspname, pg_get_userbyid(nspowner) FROM pg_catalog.pg_namespace WHERE nspname NOT IN ('pg_catalog', 'information_schema', 'pg_toast') AND nspname NOT LIKE 'pg_temp_%' AND nspname NOT LIKE 'pg_toast_temp_%'")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var names []string
+	var schemas []SchemaDefinition
 	for rows.Next() {
-		var schema string
-		if err := rows.Scan(&schema); err != nil {
+		var schema, owner string
+		if err := rows.Scan(&schema, &owner); err != nil {
 			return nil, err
 		}
-		names = append(names, joinSchemaName(database, schema))
+		schemas = append(schemas, SchemaDefinition{Name: joinSchemaName(database, schema), Owner: owner})
 	}
-	return names, nil
+	return schemas, nil
 }
 
 func joinSchemaName(database, schema string) string {
 	return database + "." + safeIdentifier(schema)
 }
 
+// matchesAny returns whether name matches any of the glob patterns (in the syntax of path.Match).
+func matchesAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// unlistedDatabases returns the existing databases that should be dropped because of manage_all_databases.
+// Databases matching one of the unmanaged patterns, the template databases and the database we're connected to are never returned.
+func unlistedDatabases(actual, wanted []DatabaseDefinition, unmanaged []string, currentDatabase string) []string {
+	names := databaseNames(wanted)
+	var ret []string
+	for _, d := range actual {
+		if lo.Contains(names, d.Name) || matchesAny(unmanaged, d.Name) || d.Name == "template0" || d.Name == "template1" || d.Name == currentDatabase {
+			continue
+		}
+		ret = append(ret, d.Name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// unlistedSchemas returns the existing schemas that should be dropped because of manage_all_schemas.
+// Schemas matching one of the unmanaged patterns are never returned.
+func unlistedSchemas(actual, wanted []SchemaDefinition, unmanaged []string) []string {
+	names := schemaNames(wanted)
+	var ret []string
+	for _, s := range actual {
+		if lo.Contains(names, s.Name) || matchesAny(unmanaged, s.Name) {
+			continue
+		}
+		ret = append(ret, s.Name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
 // SyncDatabases tells the SyncSink which queries should be executed to create/delete the databases.
-func SyncDatabases(ss SyncSink, wanted, tombstoned, actual []string) {
-	a := map[string]struct{}{}
+// The server version is needed to pick the way to terminate sessions when dropping a database with force.
+func SyncDatabases(ss SyncSink, wanted []DatabaseDefinition, tombstoned []TombstonedDatabase, actual []DatabaseDefinition, serverVersion int) {
+	a := map[string]DatabaseDefinition{}
 	for _, d := range actual {
-		a[d] = struct{}{}
+		a[d.Name] = d
 	}
+	for _, d := range tombstoned {
+		if _, exists := a[d.Name]; !exists || !d.Force || serverVersion >= 130000 {
+			continue
+		}
+		// Before PostgreSQL 13 there is no DROP DATABASE ... WITH (FORCE). Prevent new sessions and terminate the existing ones instead.
+		// If dropping the database fails afterwards, it's left with allow_connections disabled. Syncing again retries the drop.
+		emit(ss, "", AlterDatabase{Name: d.Name, AllowConnections: new(bool)})
+		emit(ss, "", TerminateSessions{Database: d.Name})
+	}
+	ss.AddBarrier()
 	for _, d := range wanted {
-		if _, exists := a[d]; exists {
+		if _, exists := a[d.Name]; exists {
 			continue
 		}
-		ss.Query("", "CREATE DATABASE "+safeIdentifier(d))
+		emit(ss, "", CreateDatabase{Database: d})
 	}
 	for _, d := range tombstoned {
-		if _, exists := a[d]; !exists {
+		if _, exists := a[d.Name]; !exists {
 			continue
 		}
-		ss.Query("", "DROP DATABASE "+safeIdentifier(d))
+		emit(ss, "", DropDatabase{Name: d.Name, Force: d.Force && serverVersion >= 130000})
+	}
+}
+
+// SyncDatabaseAttributes tells the SyncSink which queries should be executed to give the databases the desired owner, connection limit, allow_connections and is_template.
+// It should be called after the queries from SyncDatabases and SyncRoles, so new databases and roles exist.
+func SyncDatabaseAttributes(ss SyncSink, wanted, actual []DatabaseDefinition) {
+	a := map[string]DatabaseDefinition{}
+	for _, d := range actual {
+		a[d.Name] = d
+	}
+	for _, d := range wanted {
+		o, exists := a[d.Name]
+		if !exists {
+			// Databases created by SyncDatabases already have the desired connection limit.
+			o = DatabaseDefinition{Name: d.Name, ConnectionLimit: d.ConnectionLimit}
+		}
+		if d.Owner != "" && o.Owner != d.Owner {
+			emit(ss, "", AlterOwner{ObjectType: "DATABASE", Object: safeIdentifier(d.Name), Owner: d.Owner})
+		}
+		c := AlterDatabase{Name: d.Name}
+		if d.ConnectionLimit != nil && o.GetConnectionLimit() != *d.ConnectionLimit {
+			c.ConnectionLimit = d.ConnectionLimit
+		}
+		if d.AllowConnections != nil && o.GetAllowConnections() != *d.AllowConnections {
+			c.AllowConnections = d.AllowConnections
+		}
+		if d.IsTemplate != nil && o.GetIsTemplate() != *d.IsTemplate {
+			c.IsTemplate = d.IsTemplate
+		}
+		if c != (AlterDatabase{Name: d.Name}) {
+			emit(ss, "", c)
+		}
 	}
 }
 
 // SyncSchemas tells the SyncSink which queries should be executed to create/delete the schemas.
-func SyncSchemas(ss SyncSink, wanted, tombstoned, actual []string) {
-	a := map[string]struct{}{}
+func SyncSchemas(ss SyncSink, wanted []SchemaDefinition, tombstoned []string, actual []SchemaDefinition) {
+	a := map[string]SchemaDefinition{}
 	for _, s := range actual {
-		a[s] = struct{}{}
+		a[s.Name] = s
 	}
 	for _, s := range wanted {
-		if _, exists := a[s]; exists {
+		if _, exists := a[s.Name]; exists {
 			continue
 		}
-		db, schema := splitObjectName(s)
-		ss.Query(db, "CREATE SCHEMA "+safeIdentifier(schema))
+		db, schema := splitObjectName(s.Name)
+		emit(ss, db, CreateSchema{Name: schema, Owner: s.Owner})
 	}
 	for _, s := range tombstoned {
 		if _, exists := a[s]; !exists {
 			continue
 		}
 		db, schema := splitObjectName(s)
-		ss.Query(db, "DROP SCHEMA "+safeIdentifier(schema))
+		emit(ss, db, DropSchema{Name: schema})
+	}
+}
+
+// SyncSchemaOwners tells the SyncSink which queries should be executed to give the existing schemas the desired owners.
+// New schemas already get their owner from SyncSchemas.
+func SyncSchemaOwners(ss SyncSink, wanted, actual []SchemaDefinition) {
+	a := map[string]SchemaDefinition{}
+	for _, s := range actual {
+		a[s.Name] = s
+	}
+	for _, s := range wanted {
+		o, exists := a[s.Name]
+		if !exists || s.Owner == "" || o.Owner == s.Owner {
+			continue
+		}
+		db, schema := splitObjectName(s.Name)
+		emit(ss, db, AlterOwner{ObjectType: "SCHEMA", Object: safeIdentifier(schema), Owner: s.Owner})
 	}
 }
@@ -0,0 +1,207 @@
+package pgperms
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/samber/lo"
+)
+
+// DefaultPrivilege is a set of privileges that will be granted on objects created in the future.
+type DefaultPrivilege struct {
+	// Owner is the role creating the objects. Privileges only apply to objects created by this role.
+	Owner    string `yaml:"owner"`
+	Database string `yaml:"database"`
+	// Schema is optional. If set, the privileges only apply to objects created in this schema.
+	Schema string `yaml:"schema,omitempty"`
+	// ObjectType is one of tables, sequences, functions, types or schemas.
+	ObjectType string `yaml:"object_type"`
+
+	Roles      []string `yaml:"roles,flow"`
+	Privileges []string `yaml:"privileges,flow"`
+	Grantable  bool     `yaml:"grantable,omitempty"`
+}
+
+// defaultPrivilegeTypes maps object types in the config to the GenericPrivilege field with the same privileges.
+var defaultPrivilegeTypes = map[string]string{
+	"tables":    "tables",
+	"sequences": "sequences",
+	"functions": "routines",
+	"types":     "types",
+	"schemas":   "schemas",
+}
+
+// defaultPrivilegeCatalogTypes maps pg_default_acl.defaclobjtype to the object types in the config.
+var defaultPrivilegeCatalogTypes = map[byte]string{
+	'r': "tables",
+	'S': "sequences",
+	'f': "functions",
+	'T': "types",
+	'n': "schemas",
+}
+
+// key returns the owner, database and schema joined together. It is used as the target when converting to a GenericPrivilege.
+func (dp DefaultPrivilege) key() string {
+	return dp.Database + "\x00" + dp.Owner + "\x00" + dp.Schema
+}
+
+func splitDefaultPrivilegeKey(key string) (database, owner, schema string) {
+	sp := strings.SplitN(key, "\x00", 3)
+	return sp[0], sp[1], sp[2]
+}
+
+// defaultPrivilegesToGeneric converts the default privileges to GenericPrivileges so we can use the diffing and merging logic for them.
+func defaultPrivilegesToGeneric(dps []DefaultPrivilege) map[string][]GenericPrivilege {
+	ret := map[string][]GenericPrivilege{}
+	for _, dp := range dps {
+		gp := GenericPrivilege{
+			Roles:      dp.Roles,
+			Privileges: dp.Privileges,
+			Grantable:  dp.Grantable,
+		}
+		gp.set(defaultPrivilegeTypes[dp.ObjectType], []string{dp.key()})
+		ret[dp.ObjectType] = append(ret[dp.ObjectType], gp)
+	}
+	return ret
+}
+
+// defaultPrivilegesPublicKeys returns the keys of all default privileges that mention PUBLIC.
+func defaultPrivilegesPublicKeys(privs []DefaultPrivilege) []string {
+	var ret []string
+	for _, p := range privs {
+		if lo.Contains(p.Roles, publicRole) {
+			ret = append(ret, p.ObjectType+"\x00"+p.key())
+		}
+	}
+	return ret
+}
+
+// defaultPrivilegesWithoutPublic removes PUBLIC from all default privileges except the ones with managed keys (as returned by defaultPrivilegesPublicKeys).
+func defaultPrivilegesWithoutPublic(privs []DefaultPrivilege, managed []string) []DefaultPrivilege {
+	var ret []DefaultPrivilege
+	for _, p := range privs {
+		if lo.Contains(managed, p.ObjectType+"\x00"+p.key()) {
+			ret = append(ret, p)
+			continue
+		}
+		p.Roles = lo.Without(p.Roles, publicRole)
+		if len(p.Roles) > 0 {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+func fetchDefaultPrivileges(ctx context.Context, conn *pgx.Conn, database string, interestingUsers []string) ([]DefaultPrivilege, error) {
+	// The owner is excluded as a grantee, because it implicitly has all privileges on its own objects.
+	// Without a global entry PostgreSQL uses acldefault(), which grants EXECUTE on functions and USAGE on types to PUBLIC. We add those for the interesting owners that don't have one.
+	rows, err := conn.Query(ctx, "SELECT pg_get_userbyid(defaclrole), COALESCE(nspname, ''), defaclobjtype, "+granteeName+" AS grantee, privilege_type, is_grantable FROM ("+
+		"SELECT defaclrole, defaclnamespace, defaclobjtype, defaclacl FROM pg_catalog.pg_default_acl "+
+		"UNION ALL SELECT pg_roles.oid, 0::oid, objtype, acldefault(objtype, pg_roles.oid) FROM pg_catalog.pg_roles, (VALUES ('f'::\"char\"), ('T'::\"char\")) AS implicit(objtype) WHERE rolname = ANY($1) AND NOT EXISTS (SELECT 1 FROM pg_catalog.pg_default_acl WHERE defaclrole = pg_roles.oid AND defaclnamespace = 0 AND defaclobjtype = objtype)"+
+		") AS defacl LEFT JOIN pg_catalog.pg_namespace ON pg_namespace.oid = defaclnamespace, aclexplode(defaclacl) WHERE grantee != defaclrole AND "+granteeName+" = ANY($1)", interestingUsers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	type ownerSchemaType struct {
+		owner      string
+		schema     string
+		objectType string
+	}
+	grouped := map[string]map[ownerSchemaType]map[bool]privilegeSet{}
+	for rows.Next() {
+		var owner, schema, grantee, privilege string
+		var objtype byte
+		var grantable bool
+		if err := rows.Scan(&owner, &schema, &objtype, &grantee, &privilege, &grantable); err != nil {
+			return nil, err
+		}
+		if schema != "" {
+			schema = safeIdentifier(schema)
+		}
+		k := ownerSchemaType{owner, schema, defaultPrivilegeCatalogTypes[objtype]}
+		if grouped[grantee][k] == nil {
+			if grouped[grantee] == nil {
+				grouped[grantee] = map[ownerSchemaType]map[bool]privilegeSet{}
+			}
+			grouped[grantee][k] = map[bool]privilegeSet{}
+		}
+		ps := grouped[grantee][k][grantable]
+		ps.Add(privilege)
+		grouped[grantee][k][grantable] = ps
+	}
+	var privs []DefaultPrivilege
+	for grantee, tmp1 := range grouped {
+		for k, tmp2 := range tmp1 {
+			for grantable, ps := range tmp2 {
+				privs = append(privs, DefaultPrivilege{
+					Owner:      k.owner,
+					Database:   database,
+					Schema:     k.schema,
+					ObjectType: k.objectType,
+					Roles:      []string{grantee},
+					Privileges: ps.ListOrAll(defaultPrivilegeTypes[k.objectType]),
+					Grantable:  grantable,
+				})
+			}
+		}
+	}
+	return privs, nil
+}
+
+// mergeDefaultPrivileges tries to group default privileges together for smaller config files.
+func mergeDefaultPrivileges(input []DefaultPrivilege) []DefaultPrivilege {
+	var ret []DefaultPrivilege
+	generic := defaultPrivilegesToGeneric(input)
+	objectTypes := lo.Keys(generic)
+	sort.Strings(objectTypes)
+	for _, objectType := range objectTypes {
+		for _, gp := range mergePrivileges(generic[objectType]) {
+			for _, target := range gp.untypedTargets() {
+				database, owner, schema := splitDefaultPrivilegeKey(target)
+				ret = append(ret, DefaultPrivilege{
+					Owner:      owner,
+					Database:   database,
+					Schema:     schema,
+					ObjectType: objectType,
+					Roles:      gp.Roles,
+					Privileges: gp.Privileges,
+					Grantable:  gp.Grantable,
+				})
+			}
+		}
+	}
+	return ret
+}
+
+// applyDefaultPrivileges tells the SyncSink which queries should be executed to grant/revoke the given default privileges.
+func applyDefaultPrivileges(ss SyncSink, objectType string, granting, justPrivs bool, diff []GenericPrivilege) {
+	for _, n := range mergePrivileges(diff) {
+		for _, target := range n.untypedTargets() {
+			database, owner, schema := splitDefaultPrivilegeKey(target)
+			if granting {
+				emit(ss, database, GrantDefaultPrivilege{Owner: owner, Schema: schema, ObjectType: objectType, Privileges: n.Privileges, Roles: n.Roles, Grantable: n.Grantable})
+			} else {
+				emit(ss, database, RevokeDefaultPrivilege{Owner: owner, Schema: schema, ObjectType: objectType, Privileges: n.Privileges, Roles: n.Roles, GrantOptionOnly: justPrivs})
+			}
+		}
+	}
+}
+
+// SyncDefaultPrivileges tells the SyncSink which queries to execute to get towards the desired default privileges.
+func SyncDefaultPrivileges(ss SyncSink, actual, desired []DefaultPrivilege) {
+	a := defaultPrivilegesToGeneric(actual)
+	d := defaultPrivilegesToGeneric(desired)
+	objectTypes := lo.Keys(defaultPrivilegeTypes)
+	sort.Strings(objectTypes)
+	for _, objectType := range objectTypes {
+		grant, grantPrivs := diffPrivileges(a[objectType], d[objectType])
+		grant = append(grant, grantPrivs...)
+		revoke, revokePrivs := diffPrivileges(d[objectType], a[objectType])
+		applyDefaultPrivileges(ss, objectType, true, false, grant)
+		applyDefaultPrivileges(ss, objectType, false, false, revoke)
+		applyDefaultPrivileges(ss, objectType, false, true, revokePrivs)
+	}
+}
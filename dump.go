@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/Jille/dfr"
 	"github.com/samber/lo"
@@ -18,10 +19,18 @@ func Dump(ctx context.Context, conns *Connections) (string, error) {
 	}
 	c.TablePrivileges = mergePrivileges(c.TablePrivileges)
 	c.SequencePrivileges = mergePrivileges(c.SequencePrivileges)
+	c.ColumnPrivileges = mergeColumns(mergePrivileges(c.ColumnPrivileges))
 	c.DatabasePrivileges = mergePrivileges(c.DatabasePrivileges)
+	c.TablespacePrivileges = mergePrivileges(c.TablespacePrivileges)
 	c.SchemaPrivileges = mergePrivileges(c.SchemaPrivileges)
 	c.TypePrivileges = mergePrivileges(c.TypePrivileges)
+	c.RoutinePrivileges = mergePrivileges(c.RoutinePrivileges)
 	c.LanguagePrivileges = mergePrivileges(c.LanguagePrivileges)
+	c.ForeignDataWrapperPrivileges = mergePrivileges(c.ForeignDataWrapperPrivileges)
+	c.ForeignServerPrivileges = mergePrivileges(c.ForeignServerPrivileges)
+	c.LargeObjectPrivileges = mergePrivileges(c.LargeObjectPrivileges)
+	c.DefaultPrivileges = mergeDefaultPrivileges(c.DefaultPrivileges)
+	c.Ownership = mergeOwnership(c.Ownership)
 	b, err := yaml.Marshal(c)
 	if err != nil {
 		return "", err
@@ -40,20 +49,25 @@ func Gather(ctx context.Context, conns *Connections, interestingRoles, interesti
 	}
 	ret.Roles = roles
 	if len(interestingRoles) == 0 {
-		interestingRoles = lo.Keys(roles)
+		interestingRoles = append(lo.Keys(roles), publicRole)
 	}
 	ret.Databases, err = fetchDatabases(ctx, conns.primary)
 	if err != nil {
 		return nil, err
 	}
 	if len(interestingDatabases) == 0 {
-		interestingDatabases = ret.Databases
+		interestingDatabases = databaseNames(ret.Databases)
 	}
 	ret.DatabasePrivileges, err = fetchDatabasesPrivileges(ctx, conns.primary, interestingRoles, interestingDatabases)
 	if err != nil {
 		return nil, err
 	}
-	for _, dbname := range lo.Intersect(interestingDatabases, ret.Databases) {
+	ret.TablespacePrivileges, err = fetchTablespacePrivileges(ctx, conns.primary, interestingRoles)
+	if err != nil {
+		return nil, err
+	}
+	for _, dbname := range lo.Intersect(interestingDatabases, connectableDatabaseNames(ret.Databases)) {
+		start := time.Now()
 		dbconn, deref, err := conns.Get(dbname)
 		if err != nil {
 			return nil, err
@@ -78,19 +92,64 @@ func Gather(ctx context.Context, conns *Connections, interestingRoles, interesti
 		ret.TablePrivileges = append(ret.TablePrivileges, tblPrivs...)
 		ret.SequencePrivileges = append(ret.SequencePrivileges, seqPrivs...)
 
+		colPrivs, err := fetchColumnPrivileges(ctx, dbconn, dbname, interestingRoles)
+		if err != nil {
+			return nil, err
+		}
+		ret.ColumnPrivileges = append(ret.ColumnPrivileges, colPrivs...)
+
 		typPrivs, err := fetchTypePrivileges(ctx, dbconn, dbname, interestingRoles)
 		if err != nil {
 			return nil, err
 		}
 		ret.TypePrivileges = append(ret.TypePrivileges, typPrivs...)
 
+		routinePrivs, err := fetchRoutinePrivileges(ctx, dbconn, dbname, interestingRoles)
+		if err != nil {
+			return nil, err
+		}
+		ret.RoutinePrivileges = append(ret.RoutinePrivileges, routinePrivs...)
+
 		langPrivs, err := fetchLanguagePrivileges(ctx, dbconn, dbname, interestingRoles)
 		if err != nil {
 			return nil, err
 		}
 		ret.LanguagePrivileges = append(ret.LanguagePrivileges, langPrivs...)
 
+		fdwPrivs, err := fetchForeignDataWrapperPrivileges(ctx, dbconn, dbname, interestingRoles)
+		if err != nil {
+			return nil, err
+		}
+		ret.ForeignDataWrapperPrivileges = append(ret.ForeignDataWrapperPrivileges, fdwPrivs...)
+
+		srvPrivs, err := fetchForeignServerPrivileges(ctx, dbconn, dbname, interestingRoles)
+		if err != nil {
+			return nil, err
+		}
+		ret.ForeignServerPrivileges = append(ret.ForeignServerPrivileges, srvPrivs...)
+
+		loPrivs, err := fetchLargeObjectPrivileges(ctx, dbconn, dbname, interestingRoles)
+		if err != nil {
+			return nil, err
+		}
+		ret.LargeObjectPrivileges = append(ret.LargeObjectPrivileges, loPrivs...)
+
+		defPrivs, err := fetchDefaultPrivileges(ctx, dbconn, dbname, interestingRoles)
+		if err != nil {
+			return nil, err
+		}
+		ret.DefaultPrivileges = append(ret.DefaultPrivileges, defPrivs...)
+
+		owned, err := fetchOwnership(ctx, dbconn, dbname)
+		if err != nil {
+			return nil, err
+		}
+		ret.Ownership = append(ret.Ownership, owned...)
+
 		derefNow(true)
+		if conns.onGather != nil {
+			conns.onGather(dbname, time.Since(start))
+		}
 	}
 	return &ret, nil
 }
@@ -98,47 +157,135 @@ func Gather(ctx context.Context, conns *Connections, interestingRoles, interesti
 // Sync the desired configuration to a running cluster.
 // Queries to be executed are sent to the SyncSink, not executed on the given connections.
 func Sync(ctx context.Context, conns *Connections, desired []byte, ss SyncSink) error {
+	_, _, _, err := syncConfig(ctx, conns, desired, ss, nil)
+	return err
+}
+
+// syncConfig is Sync, but also returns the state of the cluster as gathered before calculating the queries, and the desired config with its wildcards resolved.
+// If rollback isn't nil, it's told which queries undo the changes, and the changes that can't be undone are returned.
+func syncConfig(ctx context.Context, conns *Connections, desired []byte, ss, rollback SyncSink) (*Config, *Config, []string, error) {
 	dec := yaml.NewDecoder(bytes.NewReader(desired))
 	dec.KnownFields(true)
 	var d Config
 	if err := dec.Decode(&d); err != nil {
-		return err
+		return nil, nil, nil, err
 	}
 	if err := ValidateConfig(&d); err != nil {
-		return err
+		return nil, nil, nil, err
+	}
+	databases := databaseNames(d.Databases)
+	interestingRoles := lo.Keys(d.Roles)
+	if d.mentionsPublic() {
+		interestingRoles = append(interestingRoles, publicRole)
+	}
+	actual, err := Gather(ctx, conns, interestingRoles, databases)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	version, err := serverVersion(ctx, conns.primary)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := checkMembershipOptions(d.Roles, version); err != nil {
+		return nil, nil, nil, err
 	}
-	actual, err := Gather(ctx, conns, lo.Keys(d.Roles), d.Databases)
+	existingDatabases := connectableDatabaseNames(actual.Databases)
+	d.TablePrivileges, err = expandTables(ctx, conns, d.TablePrivileges, existingDatabases)
 	if err != nil {
-		return err
+		return nil, nil, nil, err
 	}
-	d.TablePrivileges, err = expandTables(ctx, conns, d.TablePrivileges, actual.Databases)
+	d.SequencePrivileges, err = expandSequences(ctx, conns, d.SequencePrivileges, existingDatabases)
 	if err != nil {
-		return err
+		return nil, nil, nil, err
 	}
-	d.SequencePrivileges, err = expandSequences(ctx, conns, d.SequencePrivileges, actual.Databases)
+	d.RoutinePrivileges, err = expandRoutines(ctx, conns, d.RoutinePrivileges, existingDatabases)
 	if err != nil {
-		return err
+		return nil, nil, nil, err
 	}
+	d.LargeObjectPrivileges, err = expandLargeObjects(ctx, conns, d.LargeObjectPrivileges, existingDatabases)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	d.Ownership, err = expandOwnership(ctx, conns, d.Ownership, existingDatabases)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	d.ColumnPrivileges = expandColumns(d.ColumnPrivileges)
+	// PUBLIC is only managed for the objects that the config mentions it for, so that we don't revoke the defaults everywhere.
+	actualSections := actual.genericPrivileges()
+	for i, desired := range d.genericPrivileges() {
+		*actualSections[i] = withoutPublic(*actualSections[i], publicTargets(*desired))
+	}
+	actual.DefaultPrivileges = defaultPrivilegesWithoutPublic(actual.DefaultPrivileges, defaultPrivilegesPublicKeys(d.DefaultPrivileges))
 	if err := encryptPasswordsInConfig(ctx, conns.primary, d.Roles); err != nil {
-		return fmt.Errorf("failed to encrypt plain-text passwords in the config: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to encrypt plain-text passwords in the config: %v", err)
+	}
+
+	tombstonedDatabases := d.TombstonedDatabases
+	if d.ManageAllDatabases {
+		for _, db := range unlistedDatabases(actual.Databases, d.Databases, d.UnmanagedDatabases, conns.primary.Config().Database) {
+			if !lo.Contains(tombstonedDatabaseNames(d.TombstonedDatabases), db) {
+				tombstonedDatabases = append(tombstonedDatabases, TombstonedDatabase{Name: db})
+			}
+		}
+	}
+	tombstonedSchemas := d.TombstonedSchemas
+	if d.ManageAllSchemas {
+		tombstonedSchemas = lo.Union(tombstonedSchemas, unlistedSchemas(actual.Schemas, d.Schemas, d.UnmanagedSchemas))
+	}
+	tombstonedRoles := d.TombstonedRoles
+	if d.ManageAllRoles {
+		superuser, err := bootstrapSuperuser(ctx, conns.primary)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, r := range unlistedRoles(actual.Roles, d.Roles, d.UnmanagedRoles, conns.primary.Config().User, superuser) {
+			if !lo.Contains(tombstonedRoleNames(d.TombstonedRoles), r) {
+				tombstonedRoles = append(tombstonedRoles, TombstonedRole{Name: r})
+			}
+		}
 	}
 
-	SyncDatabases(ss, d.Databases, d.TombstonedDatabases, actual.Databases)
+	SyncDatabases(ss, d.Databases, tombstonedDatabases, actual.Databases, version)
+	ss.AddBarrier()
+	SyncRoles(ss, actual.Roles, d.Roles, tombstonedRoles, lo.Without(reassignableDatabaseNames(actual.Databases), tombstonedDatabaseNames(tombstonedDatabases)...))
 	ss.AddBarrier()
-	SyncRoles(ss, actual.Roles, d.Roles, d.TombstonedRoles)
+	SyncDatabaseAttributes(ss, d.Databases, actual.Databases)
 	ss.AddBarrier()
 	SyncPrivileges(ss, []string{""}, actual.DatabasePrivileges, d.DatabasePrivileges)
 	ss.AddBarrier()
-	SyncSchemas(ss, d.Schemas, d.TombstonedSchemas, actual.Schemas)
+	SyncPrivileges(ss, []string{""}, actual.TablespacePrivileges, d.TablespacePrivileges)
+	ss.AddBarrier()
+	SyncSchemas(ss, d.Schemas, tombstonedSchemas, actual.Schemas)
+	ss.AddBarrier()
+	SyncSchemaOwners(ss, d.Schemas, actual.Schemas)
 	ss.AddBarrier()
-	SyncPrivileges(ss, d.Databases, actual.SchemaPrivileges, d.SchemaPrivileges)
+	SyncOwnership(ss, actual.Ownership, d.Ownership)
 	ss.AddBarrier()
-	SyncPrivileges(ss, d.Databases, actual.TypePrivileges, d.TypePrivileges)
+	SyncPrivileges(ss, databases, actual.SchemaPrivileges, d.SchemaPrivileges)
 	ss.AddBarrier()
-	SyncPrivileges(ss, d.Databases, actual.TablePrivileges, d.TablePrivileges)
+	SyncPrivileges(ss, databases, actual.TypePrivileges, d.TypePrivileges)
 	ss.AddBarrier()
-	SyncPrivileges(ss, d.Databases, actual.SequencePrivileges, d.SequencePrivileges)
+	SyncPrivileges(ss, databases, actual.TablePrivileges, d.TablePrivileges)
 	ss.AddBarrier()
-	SyncPrivileges(ss, d.Databases, actual.LanguagePrivileges, d.LanguagePrivileges)
-	return nil
+	SyncPrivileges(ss, databases, actual.SequencePrivileges, d.SequencePrivileges)
+	ss.AddBarrier()
+	SyncPrivileges(ss, databases, actual.ColumnPrivileges, d.ColumnPrivileges)
+	ss.AddBarrier()
+	SyncPrivileges(ss, databases, actual.LanguagePrivileges, d.LanguagePrivileges)
+	ss.AddBarrier()
+	SyncPrivileges(ss, databases, actual.RoutinePrivileges, d.RoutinePrivileges)
+	ss.AddBarrier()
+	SyncPrivileges(ss, databases, actual.ForeignDataWrapperPrivileges, d.ForeignDataWrapperPrivileges)
+	ss.AddBarrier()
+	SyncPrivileges(ss, databases, actual.ForeignServerPrivileges, d.ForeignServerPrivileges)
+	ss.AddBarrier()
+	SyncPrivileges(ss, databases, actual.LargeObjectPrivileges, d.LargeObjectPrivileges)
+	ss.AddBarrier()
+	SyncDefaultPrivileges(ss, actual.DefaultPrivileges, d.DefaultPrivileges)
+	if rollback == nil {
+		return actual, &d, nil, nil
+	}
+	irreversible := syncRollback(rollback, actual, &d, tombstonedRoles, tombstonedDatabases, tombstonedSchemas, version)
+	return actual, &d, irreversible, nil
 }
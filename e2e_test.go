@@ -88,10 +88,6 @@ func TestEndToEnd(t *testing.T) {
 			}
 
 			// 3. Execute the pgperms queries
-			for _, db := range tc.Config.TombstonedDatabases {
-				// Disconnect so we can drop the database.
-				conns.DropCachedConnection(db)
-			}
 			if err := rec.Apply(ctx, conns); err != nil {
 				t.Errorf("Failed to execute queries: %v", err)
 			}
@@ -117,6 +113,10 @@ func checkClusterIsEmpty(ctx context.Context, t *testing.T, conn *pgx.Conn) {
 	checkNoResults(ctx, t, conn, "SELECT nspname FROM pg_catalog.pg_namespace WHERE nspname NOT IN ('public', 'pg_catalog', 'information_schema', 'pg_toast') AND nspname NOT LIKE 'pg_temp_%' AND nspname NOT LIKE 'pg_toast_temp_%'", "Database is not empty: found schema %s")
 	checkNoResults(ctx, t, conn, "SELECT rolname FROM pg_catalog.pg_authid WHERE rolname NOT LIKE 'pg_%' AND rolname!='postgres'", "Database is not empty: found user %s")
 	checkNoResults(ctx, t, conn, "SELECT relname FROM pg_catalog.pg_class WHERE relnamespace NOT IN (SELECT oid FROM pg_catalog.pg_namespace WHERE nspname IN ('pg_catalog', 'information_schema', 'pg_toast'))", "Database is not empty: found table %s")
+	checkNoResults(ctx, t, conn, "SELECT fdwname FROM pg_catalog.pg_foreign_data_wrapper", "Database is not empty: found foreign data wrapper %s")
+	checkNoResults(ctx, t, conn, "SELECT srvname FROM pg_catalog.pg_foreign_server", "Database is not empty: found foreign server %s")
+	checkNoResults(ctx, t, conn, "SELECT oid::text FROM pg_catalog.pg_largeobject_metadata", "Database is not empty: found large object %s")
+	checkNoResults(ctx, t, conn, "SELECT proname FROM pg_catalog.pg_proc WHERE pronamespace NOT IN (SELECT oid FROM pg_catalog.pg_namespace WHERE nspname IN ('pg_catalog', 'information_schema', 'pg_toast'))", "Database is not empty: found routine %s")
 	checkNoResults(ctx, t, conn, "SELECT typname FROM pg_catalog.pg_type WHERE typnamespace NOT IN (SELECT oid FROM pg_catalog.pg_namespace WHERE nspname IN ('pg_catalog', 'information_schema', 'pg_toast'))", "Database is not empty: found type %s")
 	if t.Failed() {
 		t.FailNow()
@@ -139,11 +139,18 @@ func checkNoResults(ctx context.Context, t *testing.T, conn *pgx.Conn, query, er
 }
 
 func purgeCluster(ctx context.Context, t *testing.T, conn *pgx.Conn) {
-	findAndDrop(ctx, t, conn, "SELECT relname FROM pg_catalog.pg_class WHERE relkind != 'S' AND relnamespace NOT IN (SELECT oid FROM pg_catalog.pg_namespace WHERE nspname IN ('pg_catalog', 'information_schema', 'pg_toast'))", "TABLE")
-	findAndDrop(ctx, t, conn, "SELECT relname FROM pg_catalog.pg_class WHERE relkind = 'S' AND relnamespace NOT IN (SELECT oid FROM pg_catalog.pg_namespace WHERE nspname IN ('pg_catalog', 'information_schema', 'pg_toast'))", "SEQUENCE")
-	findAndDrop(ctx, t, conn, "SELECT typname FROM pg_catalog.pg_type WHERE typnamespace NOT IN (SELECT oid FROM pg_catalog.pg_namespace WHERE nspname IN ('pg_catalog', 'information_schema', 'pg_toast')) AND typname NOT LIKE '\\_%'", "TYPE")
+	findAndDrop(ctx, t, conn, "SELECT relnamespace::regnamespace || '.' || relname FROM pg_catalog.pg_class WHERE relkind != 'S' AND relnamespace NOT IN (SELECT oid FROM pg_catalog.pg_namespace WHERE nspname IN ('pg_catalog', 'information_schema', 'pg_toast'))", "TABLE")
+	findAndDrop(ctx, t, conn, "SELECT relnamespace::regnamespace || '.' || relname FROM pg_catalog.pg_class WHERE relkind = 'S' AND relnamespace NOT IN (SELECT oid FROM pg_catalog.pg_namespace WHERE nspname IN ('pg_catalog', 'information_schema', 'pg_toast'))", "SEQUENCE")
+	findAndDrop(ctx, t, conn, "SELECT oid::regprocedure::text FROM pg_catalog.pg_proc WHERE pronamespace NOT IN (SELECT oid FROM pg_catalog.pg_namespace WHERE nspname IN ('pg_catalog', 'information_schema', 'pg_toast'))", "ROUTINE")
+	findAndDrop(ctx, t, conn, "SELECT typnamespace::regnamespace || '.' || typname FROM pg_catalog.pg_type WHERE typnamespace NOT IN (SELECT oid FROM pg_catalog.pg_namespace WHERE nspname IN ('pg_catalog', 'information_schema', 'pg_toast')) AND typname NOT LIKE '\\_%'", "TYPE")
+	if _, err := conn.Exec(ctx, "SELECT lo_unlink(oid) FROM pg_catalog.pg_largeobject_metadata"); err != nil {
+		t.Errorf("Failed to purge database: unlinking large objects: %v", err)
+	}
+	findAndDrop(ctx, t, conn, "SELECT srvname FROM pg_catalog.pg_foreign_server", "SERVER")
+	findAndDrop(ctx, t, conn, "SELECT fdwname FROM pg_catalog.pg_foreign_data_wrapper", "FOREIGN DATA WRAPPER")
 	findAndDrop(ctx, t, conn, "SELECT nspname FROM pg_catalog.pg_namespace WHERE nspname NOT IN ('public', 'pg_catalog', 'information_schema', 'pg_toast') AND nspname NOT LIKE 'pg_temp_%' AND nspname NOT LIKE 'pg_toast_temp_%'", "SCHEMA")
 	findAndDrop(ctx, t, conn, "SELECT datname FROM pg_catalog.pg_database WHERE datname NOT IN ('postgres', 'template0', 'template1')", "DATABASE")
+	findAndDrop(ctx, t, conn, "SELECT rolname FROM pg_catalog.pg_authid WHERE rolname NOT LIKE 'pg_%' AND rolname!='postgres'", "OWNED BY")
 	findAndDrop(ctx, t, conn, "SELECT rolname FROM pg_catalog.pg_authid WHERE rolname NOT LIKE 'pg_%' AND rolname!='postgres'", "USER")
 }
 
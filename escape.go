@@ -64,6 +64,30 @@ func joinTableName(database, schema, table string) string {
 	return database + "." + safeIdentifier(schema) + "." + safeIdentifier(table)
 }
 
+// joinRoutineName returns the name of a function or procedure including its argument types: database.schema.routine(argtype1, argtype2).
+func joinRoutineName(database, schema, routine, args string) string {
+	return joinTableName(database, schema, routine) + "(" + args + ")"
+}
+
+// joinColumnName returns the name of a single column in the format used by column privileges: database.schema.table.(column).
+func joinColumnName(database, schema, table, column string) string {
+	return joinTableName(database, schema, table) + ".(" + safeIdentifier(column) + ")"
+}
+
+// splitColumnName splits schema.table.(col1, col2) into the table name and the list of columns.
+// If the name has no column list, it returns the whole name and no columns.
+func splitColumnName(name string) (string, []string) {
+	i := strings.LastIndex(name, ".(")
+	if i == -1 || !strings.HasSuffix(name, ")") {
+		return name, nil
+	}
+	columns := strings.Split(name[i+2:len(name)-1], ",")
+	for j, c := range columns {
+		columns[j] = strings.TrimSpace(c)
+	}
+	return name[:i], columns
+}
+
 var safeCharactersRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
 
 func identifierNeedsEscaping(s string) bool {
@@ -2,9 +2,11 @@ package pgperms
 
 import (
 	"context"
+	"regexp"
 	"strings"
 
 	"github.com/Jille/dfr"
+	"github.com/jackc/pgx/v4"
 	"github.com/samber/lo"
 )
 
@@ -18,27 +20,184 @@ func expandSequences(ctx context.Context, conns *Connections, privs []GenericPri
 
 // expandTablesOrSequences resolves all permissions for .* to an actual list of tables.
 func expandTablesOrSequences(ctx context.Context, conns *Connections, privs []GenericPrivilege, existingDatabases []string, sequences bool) ([]GenericPrivilege, error) {
-	var d dfr.D
-	defer d.Run(nil)
-	interestingSchemas := map[string]map[string]struct{}{}
+	what := "tables"
+	lister := listTables
+	if sequences {
+		what = "sequences"
+		lister = listSequences
+	}
+	return expandPrivilegeWildcards(ctx, conns, privs, existingDatabases, what, schemaWildcard, lister)
+}
+
+// expandRoutines resolves all permissions for .* to an actual list of functions and procedures, and spells the argument types of the other routines the way PostgreSQL does.
+func expandRoutines(ctx context.Context, conns *Connections, privs []GenericPrivilege, existingDatabases []string) ([]GenericPrivilege, error) {
+	var all []string
 	for _, p := range privs {
-		for _, t := range p.untypedTargets() {
-			if !strings.HasSuffix(t, ".*") {
-				continue
-			}
-			dbname, tgt := splitObjectName(t)
-			if interestingSchemas[dbname] == nil {
-				interestingSchemas[dbname] = map[string]struct{}{}
-			}
-			interestingSchemas[dbname][strings.TrimSuffix(tgt, ".*")] = struct{}{}
+		all = append(all, p.Routines...)
+	}
+	signatures, err := resolveWildcards(ctx, conns, all, existingDatabases, routineSignature, listRoutineSignatures)
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range privs {
+		p.Routines = canonicalRoutines(p.Routines, signatures)
+		privs[i] = p
+	}
+	return expandPrivilegeWildcards(ctx, conns, privs, existingDatabases, "routines", schemaWildcard, listRoutines)
+}
+
+// expandLargeObjects resolves all permissions for database.owned_by(role) to the large objects owned by that role.
+func expandLargeObjects(ctx context.Context, conns *Connections, privs []GenericPrivilege, existingDatabases []string) ([]GenericPrivilege, error) {
+	return expandPrivilegeWildcards(ctx, conns, privs, existingDatabases, "largeObjects", ownedByWildcard, listLargeObjects)
+}
+
+// wildcardMatcher returns what a wildcardLister should look up for an object name (without the database), or false if the name isn't a wildcard.
+type wildcardMatcher func(name string) (string, bool)
+
+// schemaWildcard matches schema.* and returns the schema.
+func schemaWildcard(name string) (string, bool) {
+	if !strings.HasSuffix(name, ".*") {
+		return "", false
+	}
+	return strings.TrimSuffix(name, ".*"), true
+}
+
+var largeObjectsOwnedByRe = regexp.MustCompile(`^owned_by\((.+)\)$`)
+
+// ownedByWildcard matches owned_by(role) and returns the role.
+func ownedByWildcard(name string) (string, bool) {
+	m := largeObjectsOwnedByRe.FindStringSubmatch(name)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// routineSignature matches schema.routine(argtype1, argtype2) and returns it as is, so listRoutineSignatures can look up the routine.
+// It's not really a wildcard, but the argument types can be spelled in multiple ways (like int, int4 and integer), so we need to ask the database which routine is meant.
+func routineSignature(name string) (string, bool) {
+	if !strings.HasSuffix(name, ")") {
+		return "", false
+	}
+	return name, true
+}
+
+// wildcardLister returns the fully qualified names of all objects for the given keys (as returned by a wildcardMatcher), grouped by key. The given connection is connected to the given database.
+type wildcardLister func(ctx context.Context, conn *pgx.Conn, database string, keys []string) (map[string][]string, error)
+
+func listTables(ctx context.Context, conn *pgx.Conn, database string, schemas []string) (map[string][]string, error) {
+	return listRelations(ctx, conn, database, schemas, []string{"r", "v", "m", "f"})
+}
+
+func listSequences(ctx context.Context, conn *pgx.Conn, database string, schemas []string) (map[string][]string, error) {
+	return listRelations(ctx, conn, database, schemas, []string{"S"})
+}
+
+func listRelations(ctx context.Context, conn *pgx.Conn, database string, schemas, types []string) (map[string][]string, error) {
+	rows, err := conn.Query(ctx, "SELECT nspname, relname FROM pg_catalog.pg_class, pg_catalog.pg_namespace WHERE pg_class.relnamespace = pg_namespace.oid AND nspname = ANY($1) AND relkind = ANY($2)", schemas, types)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := map[string][]string{}
+	for rows.Next() {
+		var schema, name string
+		if err := rows.Scan(&schema, &name); err != nil {
+			return nil, err
+		}
+		names[schema] = append(names[schema], joinTableName(database, schema, name))
+	}
+	return names, rows.Err()
+}
+
+func listRoutines(ctx context.Context, conn *pgx.Conn, database string, schemas []string) (map[string][]string, error) {
+	rows, err := conn.Query(ctx, "SELECT nspname, proname, oidvectortypes(proargtypes) FROM pg_catalog.pg_proc, pg_catalog.pg_namespace WHERE pg_proc.pronamespace = pg_namespace.oid AND nspname = ANY($1)", schemas)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := map[string][]string{}
+	for rows.Next() {
+		var schema, name, args string
+		if err := rows.Scan(&schema, &name, &args); err != nil {
+			return nil, err
 		}
+		names[schema] = append(names[schema], joinRoutineName(database, schema, name, args))
 	}
-	types := []string{"S"}
-	if !sequences {
-		types = []string{"r", "v", "m", "f"}
+	return names, rows.Err()
+}
+
+// listRoutineSignatures looks up the given routines (as schema.routine(argtype1, argtype2)) and returns their fully qualified names with the argument types spelled like PostgreSQL does, keyed by the given signature.
+// Routines that don't exist are left out.
+func listRoutineSignatures(ctx context.Context, conn *pgx.Conn, database string, signatures []string) (map[string][]string, error) {
+	rows, err := conn.Query(ctx, "SELECT s, nspname, proname, oidvectortypes(proargtypes) FROM unnest($1::text[]) s, pg_catalog.pg_proc, pg_catalog.pg_namespace WHERE pg_proc.oid = to_regprocedure(s) AND pg_proc.pronamespace = pg_namespace.oid", signatures)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := map[string][]string{}
+	for rows.Next() {
+		var signature, schema, name, args string
+		if err := rows.Scan(&signature, &schema, &name, &args); err != nil {
+			return nil, err
+		}
+		names[signature] = []string{joinRoutineName(database, schema, name, args)}
+	}
+	return names, rows.Err()
+}
+
+func listLargeObjects(ctx context.Context, conn *pgx.Conn, database string, owners []string) (map[string][]string, error) {
+	rows, err := conn.Query(ctx, "SELECT pg_get_userbyid(lomowner), oid::text FROM pg_catalog.pg_largeobject_metadata WHERE pg_get_userbyid(lomowner) = ANY($1)", owners)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := map[string][]string{}
+	for rows.Next() {
+		var owner, oid string
+		if err := rows.Scan(&owner, &oid); err != nil {
+			return nil, err
+		}
+		names[owner] = append(names[owner], database+"."+oid)
+	}
+	return names, rows.Err()
+}
+
+// expandPrivilegeWildcards resolves all permissions for wildcards to an actual list of objects of the given type.
+func expandPrivilegeWildcards(ctx context.Context, conns *Connections, privs []GenericPrivilege, existingDatabases []string, what string, matcher wildcardMatcher, lister wildcardLister) ([]GenericPrivilege, error) {
+	var all []string
+	for _, p := range privs {
+		all = append(all, p.untypedTargets()...)
+	}
+	names, err := resolveWildcards(ctx, conns, all, existingDatabases, matcher, lister)
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range privs {
+		p.set(what, replaceWildcards(p.untypedTargets(), names, matcher))
+		privs[i] = p
+	}
+	return privs, nil
+}
+
+// resolveWildcards looks up the objects for every wildcard in targets. The returned map is keyed by database and the key returned by the matcher (like the schema).
+func resolveWildcards(ctx context.Context, conns *Connections, targets []string, existingDatabases []string, matcher wildcardMatcher, lister wildcardLister) (map[string]map[string][]string, error) {
+	var d dfr.D
+	defer d.Run(nil)
+	interestingKeys := map[string]map[string]struct{}{}
+	for _, t := range targets {
+		dbname, tgt := splitObjectName(t)
+		key, ok := matcher(tgt)
+		if !ok {
+			continue
+		}
+		if interestingKeys[dbname] == nil {
+			interestingKeys[dbname] = map[string]struct{}{}
+		}
+		interestingKeys[dbname][key] = struct{}{}
 	}
 	names := map[string]map[string][]string{}
-	for dbname, schemas := range interestingSchemas {
+	for dbname, keys := range interestingKeys {
 		if !lo.Contains(existingDatabases, dbname) {
 			continue
 		}
@@ -47,38 +206,56 @@ func expandTablesOrSequences(ctx context.Context, conns *Connections, privs []Ge
 			return nil, err
 		}
 		derefNow := d.Add(deref)
-		names[dbname] = map[string][]string{}
-		rows, err := conn.Query(ctx, "SELECT nspname, relname FROM pg_catalog.pg_class, pg_catalog.pg_namespace WHERE pg_class.relnamespace = pg_namespace.oid AND nspname = ANY($1) AND relkind = ANY($2)", lo.Keys(schemas), types)
+		names[dbname], err = lister(ctx, conn, dbname, lo.Keys(keys))
 		if err != nil {
 			return nil, err
 		}
-		defer rows.Close()
-		for rows.Next() {
-			var schema, name string
-			if err := rows.Scan(&schema, &name); err != nil {
-				return nil, err
-			}
-			names[dbname][schema] = append(names[dbname][schema], joinTableName(dbname, schema, name))
-		}
 		derefNow(true)
 	}
+	return names, nil
+}
+
+// replaceWildcards replaces every wildcard in targets with the objects found by resolveWildcards.
+func replaceWildcards(targets []string, names map[string]map[string][]string, matcher wildcardMatcher) []string {
+	var newTargets []string
+	for _, t := range targets {
+		dbname, tgt := splitObjectName(t)
+		key, ok := matcher(tgt)
+		if !ok {
+			newTargets = append(newTargets, t)
+			continue
+		}
+		newTargets = append(newTargets, names[dbname][key]...)
+	}
+	return newTargets
+}
+
+// canonicalRoutines replaces every routine in targets with its name as found by listRoutineSignatures. Routines that weren't found are kept as they are.
+func canonicalRoutines(targets []string, signatures map[string]map[string][]string) []string {
+	newTargets := make([]string, len(targets))
+	for i, t := range targets {
+		dbname, tgt := splitObjectName(t)
+		if names := signatures[dbname][tgt]; len(names) == 1 {
+			newTargets[i] = names[0]
+		} else {
+			newTargets[i] = t
+		}
+	}
+	return newTargets
+}
+
+// expandColumns splits every column privilege target with multiple columns into one target per column.
+func expandColumns(privs []GenericPrivilege) []GenericPrivilege {
 	for i, p := range privs {
 		var newTargets []string
-		for _, t := range p.untypedTargets() {
-			if !strings.HasSuffix(t, ".*") {
-				newTargets = append(newTargets, t)
-				continue
+		for _, t := range p.Columns {
+			table, columns := splitColumnName(t)
+			for _, c := range columns {
+				newTargets = append(newTargets, table+".("+c+")")
 			}
-			dbname, tgt := splitObjectName(t)
-			schema := strings.TrimSuffix(tgt, ".*")
-			newTargets = append(newTargets, names[dbname][schema]...)
-		}
-		if sequences {
-			p.Sequences = newTargets
-		} else {
-			p.Tables = newTargets
 		}
+		p.Columns = newTargets
 		privs[i] = p
 	}
-	return privs, nil
+	return privs
 }
@@ -0,0 +1,106 @@
+package pgperms
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/iancoleman/strcase"
+	"github.com/samber/lo"
+)
+
+// Guardrails configures which changes a Guard refuses.
+type Guardrails struct {
+	// CurrentUser is the role pgperms is connected as. Removing its SUPERUSER attribute or revoking its memberships is refused.
+	CurrentUser string
+	// MaxRevokes is the maximum number of privileges that may be revoked. Every combination of privilege, object (or column) and role counts as one, so ALL PRIVILEGES counts once for every privilege it includes. A negative number means there's no limit.
+	MaxRevokes int
+}
+
+// GuardrailError is returned when the changes violate the guardrails.
+type GuardrailError struct {
+	Violations []string
+}
+
+func (e *GuardrailError) Error() string {
+	return "refusing destructive changes: " + strings.Join(e.Violations, "; ")
+}
+
+// Guard is a SyncSink that checks every change against the Guardrails before passing it on to another SyncSink.
+// Dropping databases or schemas and DROP OWNED (which revokes every privilege of a role) are always refused.
+type Guard struct {
+	sink       SyncSink
+	guardrails Guardrails
+	violations []string
+	revokes    int
+}
+
+// NewGuard returns a Guard that passes the changes on to ss.
+func NewGuard(ss SyncSink, guardrails Guardrails) *Guard {
+	return &Guard{sink: ss, guardrails: guardrails}
+}
+
+var _ ChangeSink = &Guard{}
+
+// Query passes the query on without checking it. The Sync* functions only call Change on a ChangeSink.
+func (g *Guard) Query(database, query string) {
+	g.sink.Query(database, query)
+}
+
+func (g *Guard) AddBarrier() {
+	g.sink.AddBarrier()
+}
+
+// Change checks the change and passes it on.
+func (g *Guard) Change(database string, c Change) {
+	switch c := c.(type) {
+	case DropDatabase:
+		g.violations = append(g.violations, "drops database "+c.Name)
+	case DropSchema:
+		g.violations = append(g.violations, "drops schema "+joinSchemaName(database, c.Name))
+	case AlterRole:
+		if c.Name == g.guardrails.CurrentUser && c.Superuser != nil && !*c.Superuser {
+			g.violations = append(g.violations, "removes SUPERUSER from "+c.Name+", the role pgperms is connected as")
+		}
+	case RevokeMembership:
+		if c.Member == g.guardrails.CurrentUser {
+			g.violations = append(g.violations, "revokes membership of "+c.Role+" from "+c.Member+", the role pgperms is connected as")
+		}
+	case DropOwned:
+		// DROP OWNED is run in every database, but one violation per role is enough.
+		if v := "revokes all privileges of " + c.Role + " and drops the objects it owns"; !lo.Contains(g.violations, v) {
+			g.violations = append(g.violations, v)
+		}
+	case RevokePrivilege:
+		what := strcase.ToLowerCamel(strings.ToLower(c.ObjectType)) + "s"
+		n := len(c.Targets) * len(c.Roles)
+		if len(c.Columns) > 0 {
+			// Every column counts separately.
+			what = "columns"
+			n *= len(c.Columns)
+		}
+		g.revokes += n * privilegeCount(c.Privileges, what)
+	case RevokeDefaultPrivilege:
+		g.revokes += len(c.Roles) * privilegeCount(c.Privileges, defaultPrivilegeTypes[c.ObjectType])
+	}
+	emit(g.sink, database, c)
+}
+
+// privilegeCount returns the number of privileges in privs, counting ALL PRIVILEGES as every privilege that exists for the given section (like tables).
+func privilegeCount(privs []string, what string) int {
+	if len(privs) == 1 && privs[0] == "ALL PRIVILEGES" {
+		return len(validPrivileges[what])
+	}
+	return len(privs)
+}
+
+// Err returns a *GuardrailError describing all violations of the guardrails, or nil if there were none.
+func (g *Guard) Err() error {
+	violations := g.violations
+	if g.guardrails.MaxRevokes >= 0 && g.revokes > g.guardrails.MaxRevokes {
+		violations = append(violations, fmt.Sprintf("revokes %d privileges, more than the limit of %d", g.revokes, g.guardrails.MaxRevokes))
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return &GuardrailError{Violations: violations}
+}
@@ -0,0 +1,58 @@
+package pgperms
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/samber/lo"
+)
+
+func TestGuard(t *testing.T) {
+	rec := NewRecorder()
+	g := NewGuard(rec, Guardrails{CurrentUser: "admin", MaxRevokes: 3})
+	SyncRoles(g, map[string]RoleAttributes{
+		"admin":   {Superuser: true, Password: new(string), MemberOf: []Membership{{Role: "staff"}}},
+		"retired": {},
+	}, map[string]RoleAttributes{
+		"admin": {},
+	}, []TombstonedRole{{Name: "retired", ReassignTo: "admin"}}, []string{"app", "other"})
+	SyncDatabases(g, nil, []TombstonedDatabase{{Name: "old"}}, []DatabaseDefinition{{Name: "old"}}, 150000)
+	SyncSchemas(g, nil, []string{"app.tmp"}, []SchemaDefinition{{Name: "app.tmp"}})
+	SyncPrivileges(g, []string{"app"}, []GenericPrivilege{
+		{Roles: []string{"reader", "writer"}, Privileges: []string{"SELECT", "UPDATE"}, Tables: []string{"app.public.a", "app.public.b"}},
+	}, []GenericPrivilege{
+		{Roles: []string{"reader"}, Privileges: []string{"SELECT"}, Tables: []string{"app.public.a"}},
+	})
+	SyncPrivileges(g, []string{"app"}, []GenericPrivilege{
+		{Roles: []string{"reader"}, Privileges: []string{"UPDATE"}, Columns: []string{"app.public.c.(id, name)"}},
+	}, nil)
+	SyncPrivileges(g, []string{"app"}, []GenericPrivilege{
+		{Roles: []string{"writer"}, Privileges: []string{"ALL PRIVILEGES"}, Tables: []string{"app.public.d"}},
+		{Roles: []string{"writer"}, Privileges: []string{"ALL PRIVILEGES"}, ForeignServers: []string{"app.reporting"}},
+	}, nil)
+
+	want := &GuardrailError{Violations: []string{
+		"removes SUPERUSER from admin, the role pgperms is connected as",
+		"revokes all privileges of retired and drops the objects it owns",
+		"revokes membership of staff from admin, the role pgperms is connected as",
+		"drops database old",
+		"drops schema app.tmp",
+		"revokes 17 privileges, more than the limit of 3",
+	}}
+	if diff := cmp.Diff(want, g.Err()); diff != "" {
+		t.Errorf("Err() returned a diff (-want +got): %s", diff)
+	}
+	if len(rec.Get()) == 0 {
+		t.Errorf("Guard didn't pass the queries on")
+	}
+
+	g = NewGuard(NewRecorder(), Guardrails{CurrentUser: "admin", MaxRevokes: -1})
+	SyncRoles(g, map[string]RoleAttributes{
+		"other": {Superuser: true, Password: new(string)},
+	}, map[string]RoleAttributes{
+		"other": {Login: lo.ToPtr(false)},
+	}, nil, nil)
+	if err := g.Err(); err != nil {
+		t.Errorf("Err() returned %v for allowed changes", err)
+	}
+}
@@ -0,0 +1,157 @@
+package pgperms
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// Operation is a structured description of a query, for machine readable output.
+type Operation struct {
+	Database string `json:"database"`
+	SQL      string `json:"sql"`
+	// Kind is what the query does, like create_role, grant, revoke or drop_database.
+	Kind string `json:"kind"`
+	// ObjectType is the type of the objects the query is about, like role, table or database.
+	ObjectType string `json:"object_type,omitempty"`
+	// Roles are the roles that are affected by the query, like the grantees of a GRANT.
+	Roles []string `json:"roles,omitempty"`
+	// Targets are the objects the query is about, like the tables of a GRANT.
+	Targets []string `json:"targets,omitempty"`
+	// Destructive is whether the query drops something or terminates sessions.
+	Destructive bool `json:"destructive"`
+
+	// stableSQL is the SQL of the change with its lists sorted and passwords masked. See StableString.
+	stableSQL string
+}
+
+func (o Operation) String() string {
+	return QueryForDatabase{o.Database, o.SQL}.String()
+}
+
+// StableString is like String, but with the grantees, privileges and targets sorted and passwords masked.
+// It can be used to compare operations between runs: hashing a password uses a random salt, so the SQL to set it differs every time.
+func (o Operation) StableString() string {
+	if o.stableSQL == "" {
+		return o.String()
+	}
+	return QueryForDatabase{o.Database, o.stableSQL}.String()
+}
+
+// changeOperation returns a structured description of the change. Changes that aren't recognized get kind "other".
+func changeOperation(database string, c Change) Operation {
+	op := Operation{
+		Database:  database,
+		SQL:       c.SQL(),
+		Kind:      "other",
+		stableSQL: stableChange(c).SQL(),
+	}
+	switch c := c.(type) {
+	case CreateRole:
+		op.Kind, op.ObjectType, op.Roles = "create_role", "role", []string{c.Name}
+	case AlterRole:
+		op.Kind, op.ObjectType, op.Roles = "alter_role", "role", []string{c.Name}
+	case SetRoleSetting:
+		op.Kind, op.ObjectType, op.Roles = "alter_role", "role", []string{c.Role}
+	case ResetRoleSetting:
+		op.Kind, op.ObjectType, op.Roles = "alter_role", "role", []string{c.Role}
+	case DropRole:
+		op.Kind, op.ObjectType, op.Roles, op.Destructive = "drop_role", "role", []string{c.Name}, true
+	case ReassignOwned:
+		op.Kind, op.ObjectType, op.Roles = "reassign_owned", "role", []string{c.Role, c.NewOwner}
+	case DropOwned:
+		op.Kind, op.ObjectType, op.Roles, op.Destructive = "drop_owned", "role", []string{c.Role}, true
+	case GrantMembership:
+		op.Kind, op.ObjectType, op.Targets, op.Roles = "grant_membership", "role", []string{c.Role}, []string{c.Member}
+	case RevokeMembership:
+		op.Kind, op.ObjectType, op.Targets, op.Roles = "revoke_membership", "role", []string{c.Role}, []string{c.Member}
+	case GrantPrivilege:
+		op.Kind, op.ObjectType, op.Targets, op.Roles = "grant", privilegeObjectType(c.ObjectType, c.Columns), c.Targets, c.Roles
+	case RevokePrivilege:
+		op.Kind, op.ObjectType, op.Targets, op.Roles = "revoke", privilegeObjectType(c.ObjectType, c.Columns), c.Targets, c.Roles
+	case GrantDefaultPrivilege:
+		op.Kind, op.ObjectType, op.Targets, op.Roles = "grant_default_privileges", c.ObjectType, []string{defaultPrivilegeTarget(c.Owner, c.Schema)}, c.Roles
+	case RevokeDefaultPrivilege:
+		op.Kind, op.ObjectType, op.Targets, op.Roles = "revoke_default_privileges", c.ObjectType, []string{defaultPrivilegeTarget(c.Owner, c.Schema)}, c.Roles
+	case CreateDatabase:
+		op.Kind, op.ObjectType, op.Targets = "create_database", "database", []string{c.Database.Name}
+	case AlterDatabase:
+		op.Kind, op.ObjectType, op.Targets = "alter_database", "database", []string{c.Name}
+	case DropDatabase:
+		op.Kind, op.ObjectType, op.Targets, op.Destructive = "drop_database", "database", []string{c.Name}, true
+	case TerminateSessions:
+		op.Kind, op.ObjectType, op.Targets, op.Destructive = "terminate_sessions", "database", []string{c.Database}, true
+	case CreateSchema:
+		op.Kind, op.ObjectType, op.Targets = "create_schema", "schema", []string{c.Name}
+		if c.Owner != "" {
+			op.Roles = []string{c.Owner}
+		}
+	case DropSchema:
+		op.Kind, op.ObjectType, op.Targets, op.Destructive = "drop_schema", "schema", []string{c.Name}, true
+	case AlterOwner:
+		op.Kind, op.ObjectType, op.Targets, op.Roles = "alter_owner", objectType(c.ObjectType), []string{c.Object}, []string{c.Owner}
+	}
+	return op
+}
+
+// maskedPassword replaces passwords in StableString.
+var maskedPassword = "********"
+
+// stableChange returns a copy of the change with its lists sorted and passwords masked.
+func stableChange(c Change) Change {
+	switch c := c.(type) {
+	case CreateRole:
+		if c.Attributes.Password != nil && *c.Attributes.Password != "" {
+			c.Attributes.Password = &maskedPassword
+			c.Attributes.hashedPassword = ""
+		}
+		return c
+	case AlterRole:
+		if c.Password != nil && *c.Password != "" {
+			c.Password = &maskedPassword
+		}
+		return c
+	case GrantPrivilege:
+		c.Privileges, c.Columns, c.Targets, c.Roles = sorted(c.Privileges), sorted(c.Columns), sorted(c.Targets), sorted(c.Roles)
+		return c
+	case RevokePrivilege:
+		c.Privileges, c.Columns, c.Targets, c.Roles = sorted(c.Privileges), sorted(c.Columns), sorted(c.Targets), sorted(c.Roles)
+		return c
+	case GrantDefaultPrivilege:
+		c.Privileges, c.Roles = sorted(c.Privileges), sorted(c.Roles)
+		return c
+	case RevokeDefaultPrivilege:
+		c.Privileges, c.Roles = sorted(c.Privileges), sorted(c.Roles)
+		return c
+	}
+	return c
+}
+
+// sorted returns a sorted copy of l.
+func sorted(l []string) []string {
+	l = lo.Uniq(l)
+	sort.Strings(l)
+	return l
+}
+
+// objectType converts an object type keyword (like FOREIGN SERVER) to the lower case form used in Operation.
+func objectType(keyword string) string {
+	return strings.ReplaceAll(strings.ToLower(keyword), " ", "_")
+}
+
+// privilegeObjectType returns the object type for a GRANT or REVOKE. Privileges on columns are granted ON TABLE, but with the columns between parentheses.
+func privilegeObjectType(keyword string, columns []string) string {
+	if len(columns) > 0 {
+		return "column"
+	}
+	return objectType(keyword)
+}
+
+// defaultPrivilegeTarget describes the objects that default privileges apply to: those created by owner, optionally only in schema.
+func defaultPrivilegeTarget(owner, schema string) string {
+	if schema == "" {
+		return owner
+	}
+	return owner + " IN SCHEMA " + schema
+}
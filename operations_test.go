@@ -0,0 +1,124 @@
+package pgperms
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/samber/lo"
+)
+
+func TestOperation(t *testing.T) {
+	tests := []struct {
+		change Change
+		want   Operation
+	}{
+		{
+			change: CreateRole{Name: "someuser", Attributes: RoleAttributes{Password: lo.ToPtr("md5abc")}},
+			want:   Operation{Kind: "create_role", ObjectType: "role", Roles: []string{"someuser"}},
+		},
+		{
+			change: DropRole{Name: "goner"},
+			want:   Operation{Kind: "drop_role", ObjectType: "role", Roles: []string{"goner"}, Destructive: true},
+		},
+		{
+			change: GrantPrivilege{ObjectType: "TABLE", Privileges: []string{"SELECT", "UPDATE"}, Targets: []string{"public.a", "public.b"}, Roles: []string{"reader", "writer"}, Grantable: true},
+			want:   Operation{Kind: "grant", ObjectType: "table", Roles: []string{"reader", "writer"}, Targets: []string{"public.a", "public.b"}},
+		},
+		{
+			change: RevokePrivilege{ObjectType: "ROUTINE", Privileges: []string{"EXECUTE"}, Targets: []string{"public.f(integer, text)"}, Roles: []string{"PUBLIC"}, GrantOptionOnly: true},
+			want:   Operation{Kind: "revoke", ObjectType: "routine", Roles: []string{"PUBLIC"}, Targets: []string{"public.f(integer, text)"}},
+		},
+		{
+			change: GrantPrivilege{ObjectType: "TABLE", Privileges: []string{"SELECT"}, Columns: []string{"id", "name"}, Targets: []string{"public.customers"}, Roles: []string{"reader"}},
+			want:   Operation{Kind: "grant", ObjectType: "column", Roles: []string{"reader"}, Targets: []string{"public.customers"}},
+		},
+		{
+			change: GrantPrivilege{ObjectType: "FOREIGN SERVER", Privileges: []string{"USAGE"}, Targets: []string{"reporting"}, Roles: []string{"reader"}},
+			want:   Operation{Kind: "grant", ObjectType: "foreign_server", Roles: []string{"reader"}, Targets: []string{"reporting"}},
+		},
+		{
+			change: GrantMembership{Role: "parent", Member: "kiddo", Admin: true},
+			want:   Operation{Kind: "grant_membership", ObjectType: "role", Roles: []string{"kiddo"}, Targets: []string{"parent"}},
+		},
+		{
+			change: RevokeMembership{Role: "parent", Member: "kiddo", Option: "SET"},
+			want:   Operation{Kind: "revoke_membership", ObjectType: "role", Roles: []string{"kiddo"}, Targets: []string{"parent"}},
+		},
+		{
+			change: GrantDefaultPrivilege{Owner: "app_owner", Schema: "app", ObjectType: "tables", Privileges: []string{"SELECT"}, Roles: []string{"reader"}},
+			want:   Operation{Kind: "grant_default_privileges", ObjectType: "tables", Roles: []string{"reader"}, Targets: []string{"app_owner IN SCHEMA app"}},
+		},
+		{
+			change: RevokeDefaultPrivilege{Owner: "app_owner", ObjectType: "functions", Privileges: []string{"EXECUTE"}, Roles: []string{"PUBLIC"}},
+			want:   Operation{Kind: "revoke_default_privileges", ObjectType: "functions", Roles: []string{"PUBLIC"}, Targets: []string{"app_owner"}},
+		},
+		{
+			change: DropDatabase{Name: "my db", Force: true},
+			want:   Operation{Kind: "drop_database", ObjectType: "database", Targets: []string{"my db"}, Destructive: true},
+		},
+		{
+			change: DropSchema{Name: "my schema"},
+			want:   Operation{Kind: "drop_schema", ObjectType: "schema", Targets: []string{"my schema"}, Destructive: true},
+		},
+		{
+			change: AlterOwner{ObjectType: "TABLE", Object: "app.abc", Owner: "app_owner"},
+			want:   Operation{Kind: "alter_owner", ObjectType: "table", Roles: []string{"app_owner"}, Targets: []string{"app.abc"}},
+		},
+		{
+			change: AlterDatabase{Name: "archived", ConnectionLimit: lo.ToPtr(5)},
+			want:   Operation{Kind: "alter_database", ObjectType: "database", Targets: []string{"archived"}},
+		},
+	}
+	for _, tc := range tests {
+		r := NewRecorder()
+		emit(r, "db", tc.change)
+		tc.want.Database = "db"
+		tc.want.SQL = tc.change.SQL()
+		if diff := cmp.Diff([]Operation{tc.want}, r.Operations(), cmpopts.IgnoreUnexported(Operation{})); diff != "" {
+			t.Errorf("Operations() for %q returned a diff (-want +got): %s", tc.change.SQL(), diff)
+		}
+	}
+
+	r := NewRecorder()
+	r.Query("db", "SELECT 1")
+	if diff := cmp.Diff([]Operation{{Database: "db", SQL: "SELECT 1", Kind: "other"}}, r.Operations(), cmpopts.IgnoreUnexported(Operation{})); diff != "" {
+		t.Errorf("Operations() for a plain query returned a diff (-want +got): %s", diff)
+	}
+}
+
+func TestOperationStableString(t *testing.T) {
+	tests := []struct {
+		a, b Change
+		want string
+	}{
+		{
+			a:    GrantPrivilege{ObjectType: "TABLE", Privileges: []string{"UPDATE", "SELECT"}, Targets: []string{"public.b", "public.a"}, Roles: []string{"writer", "reader"}},
+			b:    GrantPrivilege{ObjectType: "TABLE", Privileges: []string{"SELECT", "UPDATE"}, Targets: []string{"public.a", "public.b"}, Roles: []string{"reader", "writer"}},
+			want: "GRANT SELECT, UPDATE ON TABLE public.a, public.b TO reader, writer",
+		},
+		{
+			a:    AlterRole{Name: "someuser", Password: lo.ToPtr("SCRAM-SHA-256$4096:c2FsdA==$a:b")},
+			b:    AlterRole{Name: "someuser", Password: lo.ToPtr("SCRAM-SHA-256$4096:cGVwcGVy$c:d")},
+			want: "ALTER ROLE someuser PASSWORD '********'",
+		},
+		{
+			a:    CreateRole{Name: "someuser", Attributes: RoleAttributes{Login: lo.ToPtr(true), Password: lo.ToPtr("hunter2"), hashedPassword: "SCRAM-SHA-256$4096:c2FsdA==$a:b"}},
+			b:    CreateRole{Name: "someuser", Attributes: RoleAttributes{Login: lo.ToPtr(true), Password: lo.ToPtr("hunter2"), hashedPassword: "SCRAM-SHA-256$4096:cGVwcGVy$c:d"}},
+			want: CreateRole{Name: "someuser", Attributes: RoleAttributes{Login: lo.ToPtr(true), Password: lo.ToPtr("********")}}.SQL(),
+		},
+		{
+			a:    AlterRole{Name: "someuser", Password: lo.ToPtr("")},
+			b:    AlterRole{Name: "someuser", Password: lo.ToPtr("")},
+			want: "ALTER ROLE someuser PASSWORD NULL",
+		},
+	}
+	for _, tc := range tests {
+		want := QueryForDatabase{"db", tc.want}.String()
+		for _, c := range []Change{tc.a, tc.b} {
+			if got := changeOperation("db", c).StableString(); got != want {
+				t.Errorf("StableString() for %q = %q, want %q", c.SQL(), got, want)
+			}
+		}
+	}
+}
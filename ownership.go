@@ -0,0 +1,182 @@
+package pgperms
+
+import (
+	"context"
+	"sort"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/samber/lo"
+)
+
+// Ownership describes which role should own a set of objects.
+type Ownership struct {
+	Owner string `yaml:"owner"`
+
+	Tables    []string `yaml:"tables,omitempty"`
+	Sequences []string `yaml:"sequences,omitempty"`
+	Routines  []string `yaml:"routines,omitempty"`
+}
+
+// ownedObjects returns the targets of o grouped by the keyword used in ALTER ... OWNER TO.
+func (o Ownership) ownedObjects() map[string][]string {
+	return map[string][]string{
+		"TABLE":    o.Tables,
+		"SEQUENCE": o.Sequences,
+		"ROUTINE":  o.Routines,
+	}
+}
+
+// fetchOwnership returns the owners of all tables, sequences and routines in the database. The given connection needs to be connected to the matching database.
+// Sequences that belong to a table column are skipped, because they always have the same owner as their table.
+func fetchOwnership(ctx context.Context, conn *pgx.Conn, database string) ([]Ownership, error) {
+	owned := map[string]*Ownership{}
+	get := func(owner string) *Ownership {
+		if owned[owner] == nil {
+			owned[owner] = &Ownership{Owner: owner}
+		}
+		return owned[owner]
+	}
+	rows, err := conn.Query(ctx, "SELECT nspname, relname, relkind, pg_get_userbyid(relowner) FROM pg_catalog.pg_class, pg_namespace WHERE pg_namespace.oid = relnamespace AND relkind IN ('r', 'v', 'm', 'f', 'S') AND nspname NOT IN ('pg_catalog', 'information_schema', 'pg_toast') AND nspname NOT LIKE 'pg_temp_%' AND nspname NOT LIKE 'pg_toast_temp_%' AND NOT EXISTS (SELECT 1 FROM pg_catalog.pg_depend WHERE classid = 'pg_class'::regclass AND objid = pg_class.oid AND refclassid = 'pg_class'::regclass AND deptype IN ('a', 'i'))")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var schema, name, owner string
+		var kind byte
+		if err := rows.Scan(&schema, &name, &kind, &owner); err != nil {
+			return nil, err
+		}
+		o := get(owner)
+		if kind == 'S' {
+			o.Sequences = append(o.Sequences, joinTableName(database, schema, name))
+		} else {
+			o.Tables = append(o.Tables, joinTableName(database, schema, name))
+		}
+	}
+	rows.Close()
+	rows, err = conn.Query(ctx, "SELECT nspname, proname, oidvectortypes(proargtypes), pg_get_userbyid(proowner) FROM pg_catalog.pg_proc, pg_namespace WHERE pg_namespace.oid = pronamespace AND nspname NOT IN ('pg_catalog', 'information_schema')")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var schema, name, args, owner string
+		if err := rows.Scan(&schema, &name, &args, &owner); err != nil {
+			return nil, err
+		}
+		o := get(owner)
+		o.Routines = append(o.Routines, joinRoutineName(database, schema, name, args))
+	}
+	var ret []Ownership
+	for _, o := range owned {
+		ret = append(ret, *o)
+	}
+	return ret, nil
+}
+
+// expandOwnership resolves all database.schema.* to an actual list of objects, and spells the argument types of routines the way PostgreSQL does.
+func expandOwnership(ctx context.Context, conns *Connections, ownership []Ownership, existingDatabases []string) ([]Ownership, error) {
+	var tables, sequences, routines []string
+	for _, o := range ownership {
+		tables = append(tables, o.Tables...)
+		sequences = append(sequences, o.Sequences...)
+		routines = append(routines, o.Routines...)
+	}
+	signatures, err := resolveWildcards(ctx, conns, routines, existingDatabases, routineSignature, listRoutineSignatures)
+	if err != nil {
+		return nil, err
+	}
+	tableNames, err := resolveWildcards(ctx, conns, tables, existingDatabases, schemaWildcard, listTables)
+	if err != nil {
+		return nil, err
+	}
+	sequenceNames, err := resolveWildcards(ctx, conns, sequences, existingDatabases, schemaWildcard, listSequences)
+	if err != nil {
+		return nil, err
+	}
+	routineNames, err := resolveWildcards(ctx, conns, routines, existingDatabases, schemaWildcard, listRoutines)
+	if err != nil {
+		return nil, err
+	}
+	for i, o := range ownership {
+		o.Tables = replaceWildcards(o.Tables, tableNames, schemaWildcard)
+		o.Sequences = replaceWildcards(o.Sequences, sequenceNames, schemaWildcard)
+		o.Routines = replaceWildcards(canonicalRoutines(o.Routines, signatures), routineNames, schemaWildcard)
+		ownership[i] = o
+	}
+	return ownership, nil
+}
+
+// mergeOwnership replaces the objects in a schema with database.schema.* if they're all owned by the same role, for smaller config files.
+func mergeOwnership(input []Ownership) []Ownership {
+	merged := map[string]*Ownership{}
+	for _, kind := range []string{"TABLE", "SEQUENCE", "ROUTINE"} {
+		ownersPerSchema := map[string]map[string][]string{}
+		for _, o := range input {
+			for _, t := range o.ownedObjects()[kind] {
+				db, remaining := splitObjectName(t)
+				schema, _ := splitObjectName(remaining)
+				fqsn := db + "." + schema
+				if ownersPerSchema[fqsn] == nil {
+					ownersPerSchema[fqsn] = map[string][]string{}
+				}
+				ownersPerSchema[fqsn][o.Owner] = append(ownersPerSchema[fqsn][o.Owner], t)
+			}
+		}
+		for fqsn, owners := range ownersPerSchema {
+			for owner, targets := range owners {
+				if len(owners) == 1 {
+					targets = []string{fqsn + ".*"}
+				}
+				if merged[owner] == nil {
+					merged[owner] = &Ownership{Owner: owner}
+				}
+				m := merged[owner]
+				switch kind {
+				case "TABLE":
+					m.Tables = append(m.Tables, targets...)
+				case "SEQUENCE":
+					m.Sequences = append(m.Sequences, targets...)
+				case "ROUTINE":
+					m.Routines = append(m.Routines, targets...)
+				}
+			}
+		}
+	}
+	owners := lo.Keys(merged)
+	sort.Strings(owners)
+	var ret []Ownership
+	for _, owner := range owners {
+		m := merged[owner]
+		sort.Strings(m.Tables)
+		sort.Strings(m.Sequences)
+		sort.Strings(m.Routines)
+		ret = append(ret, *m)
+	}
+	return ret
+}
+
+// SyncOwnership tells the SyncSink which queries should be executed to give the objects the desired owners.
+// Objects that weren't found by fetchOwnership are skipped.
+func SyncOwnership(ss SyncSink, actual, desired []Ownership) {
+	owners := map[string]string{}
+	for _, o := range actual {
+		for kind, targets := range o.ownedObjects() {
+			for _, t := range targets {
+				owners[kind+" "+t] = o.Owner
+			}
+		}
+	}
+	for _, o := range desired {
+		for kind, targets := range o.ownedObjects() {
+			for _, t := range targets {
+				if actualOwner, found := owners[kind+" "+t]; !found || actualOwner == o.Owner {
+					continue
+				}
+				db, tgt := splitObjectName(t)
+				emit(ss, db, AlterOwner{ObjectType: kind, Object: tgt, Owner: o.Owner})
+			}
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package pgperms
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrStalePlan is returned by Plan.CheckFresh if the cluster has changed since the plan was made.
+var ErrStalePlan = errors.New("the cluster has changed since the plan was made")
+
+// Plan is a saved set of queries, so they can be reviewed before being applied.
+type Plan struct {
+	// Config is the config file the plan was made from.
+	Config string `json:"config"`
+	// Fingerprint is a hash of the state of the cluster when the plan was made, including the objects that the wildcards in Config matched.
+	Fingerprint string `json:"fingerprint"`
+	// Operations are the queries to execute, with a description of what they do.
+	Operations []Operation `json:"operations"`
+	// Rollback are the queries that undo Operations, bringing the cluster back to the state it was in when the plan was made.
+	Rollback []QueryForDatabase `json:"rollback"`
+	// Irreversible describes the changes made by Operations that Rollback can't undo, like dropping a database.
+	Irreversible []string `json:"irreversible,omitempty"`
+}
+
+// MakePlan calculates the queries needed to sync the desired configuration, like Sync, and records the state of the cluster they're based on.
+// It also calculates the queries needed to undo the changes.
+// If guardrails isn't nil, the changes are checked against them and a *GuardrailError is returned if they're violated. The plan is returned along with that error, so callers can report what it would have done.
+func MakePlan(ctx context.Context, conns *Connections, desired []byte, guardrails *Guardrails) (*Plan, error) {
+	rec := NewRecorder()
+	var ss SyncSink = rec
+	var guard *Guard
+	if guardrails != nil {
+		guard = NewGuard(rec, *guardrails)
+		ss = guard
+	}
+	rollback := NewRecorder()
+	actual, expanded, irreversible, err := syncConfig(ctx, conns, desired, ss, rollback)
+	if err != nil {
+		return nil, err
+	}
+	fp, err := fingerprint(actual, expanded)
+	if err != nil {
+		return nil, err
+	}
+	plan := &Plan{
+		Config:       string(desired),
+		Fingerprint:  fp,
+		Operations:   rec.Operations(),
+		Rollback:     rollback.Get(),
+		Irreversible: irreversible,
+	}
+	if guard != nil {
+		if err := guard.Err(); err != nil {
+			return plan, err
+		}
+	}
+	return plan, nil
+}
+
+// CheckFresh returns ErrStalePlan if the state of the cluster is different from when the plan was made.
+func (p *Plan) CheckFresh(ctx context.Context, conns *Connections) error {
+	fresh, err := MakePlan(ctx, conns, []byte(p.Config), nil)
+	if err != nil {
+		return err
+	}
+	if fresh.Fingerprint != p.Fingerprint {
+		return ErrStalePlan
+	}
+	return nil
+}
+
+// Recorder returns a Recorder with the planned queries, so they can be applied.
+func (p *Plan) Recorder() *Recorder {
+	return &Recorder{
+		operations: p.Operations,
+		barrier:    len(p.Operations),
+	}
+}
+
+// fingerprint returns a hash of the gathered state of the cluster and the desired config with its wildcards resolved, so that objects created after making the plan (like tables matching schema.*) make it stale too.
+// The order of lists doesn't matter, because Gather doesn't return things in a stable order.
+func fingerprint(actual, desired *Config) (string, error) {
+	b, err := yaml.Marshal(map[string]*Config{"actual": actual, "desired": desired})
+	if err != nil {
+		return "", err
+	}
+	var v interface{}
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return "", err
+	}
+	v, err = canonicalize(v)
+	if err != nil {
+		return "", err
+	}
+	// encoding/json sorts map keys, so this is stable.
+	b, err = json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// canonicalize sorts all lists in v (recursively) by their JSON encoding.
+func canonicalize(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			c, err := canonicalize(e)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = c
+		}
+		return v, nil
+	case []interface{}:
+		encoded := make([]string, len(v))
+		for i, e := range v {
+			c, err := canonicalize(e)
+			if err != nil {
+				return nil, err
+			}
+			b, err := json.Marshal(c)
+			if err != nil {
+				return nil, err
+			}
+			encoded[i] = string(b)
+		}
+		sort.Strings(encoded)
+		ret := make([]interface{}, len(encoded))
+		for i, e := range encoded {
+			ret[i] = json.RawMessage(e)
+		}
+		return ret, nil
+	default:
+		return v, nil
+	}
+}
@@ -0,0 +1,72 @@
+package pgperms
+
+import "testing"
+
+func TestFingerprint(t *testing.T) {
+	a := &Config{
+		Roles: map[string]RoleAttributes{
+			"alice": {MemberOf: []Membership{{Role: "readers"}, {Role: "writers"}}},
+			"bob":   {},
+		},
+		TablePrivileges: []GenericPrivilege{
+			{Roles: []string{"alice"}, Privileges: []string{"SELECT"}, Tables: []string{"db.public.a"}},
+			{Roles: []string{"bob"}, Privileges: []string{"SELECT"}, Tables: []string{"db.public.b"}},
+		},
+	}
+	reordered := &Config{
+		Roles: map[string]RoleAttributes{
+			"bob":   {},
+			"alice": {MemberOf: []Membership{{Role: "writers"}, {Role: "readers"}}},
+		},
+		TablePrivileges: []GenericPrivilege{
+			{Roles: []string{"bob"}, Privileges: []string{"SELECT"}, Tables: []string{"db.public.b"}},
+			{Roles: []string{"alice"}, Privileges: []string{"SELECT"}, Tables: []string{"db.public.a"}},
+		},
+	}
+	changed := &Config{
+		Roles: map[string]RoleAttributes{
+			"alice": {MemberOf: []Membership{{Role: "readers"}, {Role: "writers"}}},
+			"bob":   {},
+		},
+		TablePrivileges: []GenericPrivilege{
+			{Roles: []string{"alice"}, Privileges: []string{"SELECT"}, Tables: []string{"db.public.a"}},
+			{Roles: []string{"bob"}, Privileges: []string{"SELECT", "UPDATE"}, Tables: []string{"db.public.b"}},
+		},
+	}
+	desired := &Config{
+		TablePrivileges: []GenericPrivilege{
+			{Roles: []string{"alice"}, Privileges: []string{"SELECT"}, Tables: []string{"db.public.a", "db.public.b"}},
+		},
+	}
+	// A table was created that matches db.public.*.
+	expanded := &Config{
+		TablePrivileges: []GenericPrivilege{
+			{Roles: []string{"alice"}, Privileges: []string{"SELECT"}, Tables: []string{"db.public.a", "db.public.b", "db.public.c"}},
+		},
+	}
+	fa, err := fingerprint(a, desired)
+	if err != nil {
+		t.Fatalf("fingerprint() failed: %v", err)
+	}
+	fr, err := fingerprint(reordered, desired)
+	if err != nil {
+		t.Fatalf("fingerprint() failed: %v", err)
+	}
+	fc, err := fingerprint(changed, desired)
+	if err != nil {
+		t.Fatalf("fingerprint() failed: %v", err)
+	}
+	fe, err := fingerprint(a, expanded)
+	if err != nil {
+		t.Fatalf("fingerprint() failed: %v", err)
+	}
+	if fa != fr {
+		t.Errorf("fingerprint() differs for the same config in a different order: %s vs %s", fa, fr)
+	}
+	if fa == fc {
+		t.Errorf("fingerprint() is the same for different configs: %s", fa)
+	}
+	if fa == fe {
+		t.Errorf("fingerprint() is the same when wildcards match different objects: %s", fa)
+	}
+}
@@ -1,11 +1,11 @@
 package pgperms
 
 // TODO: Better handling of superusers.
-// TODO: Handle default privileges?
 
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/iancoleman/strcase"
@@ -25,7 +25,7 @@ var validPrivileges = map[string][]string{
 	"schemas":             []string{"USAGE", "CREATE"},
 	"sequences":           []string{"SELECT", "UPDATE", "USAGE"},
 	"tables":              []string{"SELECT", "UPDATE", "INSERT", "DELETE", "TRUNCATE", "REFERENCES", "TRIGGER"},
-	"columns":             []string{"SELECT", "UPDATE", "INSERT", "DELETE"},
+	"columns":             []string{"SELECT", "INSERT", "UPDATE", "REFERENCES"},
 	"tablespaces":         []string{"CREATE"},
 	"types":               []string{"USAGE"},
 }
@@ -46,6 +46,65 @@ var shortPrivs = map[string]string{
 	"USAGE":      "U",
 }
 
+// publicRole is the pseudo-role that can be used in privileges to grant them to everyone.
+const publicRole = "PUBLIC"
+
+// granteeName is the SQL expression for the name of the grantee returned by aclexplode(). PUBLIC is grantee 0.
+const granteeName = "CASE grantee WHEN 0 THEN 'PUBLIC' ELSE pg_get_userbyid(grantee) END"
+
+// mentionsPublic returns whether any of the privileges is for PUBLIC.
+func mentionsPublic(privs []GenericPrivilege) bool {
+	for _, p := range privs {
+		if slices.Contains(p.Roles, publicRole) {
+			return true
+		}
+	}
+	return false
+}
+
+// publicTargets returns the targets of all privileges that mention PUBLIC.
+func publicTargets(privs []GenericPrivilege) []string {
+	var ret []string
+	for _, p := range privs {
+		if slices.Contains(p.Roles, publicRole) {
+			ret = append(ret, p.untypedTargets()...)
+		}
+	}
+	return ret
+}
+
+// withoutPublic removes PUBLIC from the privileges on all targets except the managed ones, so it's only managed where the config mentions it.
+func withoutPublic(privs []GenericPrivilege, managed []string) []GenericPrivilege {
+	var ret []GenericPrivilege
+	for _, p := range privs {
+		if !slices.Contains(p.Roles, publicRole) {
+			ret = append(ret, p)
+			continue
+		}
+		var managedTargets, unmanagedTargets []string
+		for _, t := range p.untypedTargets() {
+			if slices.Contains(managed, t) {
+				managedTargets = append(managedTargets, t)
+			} else {
+				unmanagedTargets = append(unmanagedTargets, t)
+			}
+		}
+		what := p.targets()[0]
+		if len(managedTargets) > 0 {
+			mp := p
+			mp.set(what, managedTargets)
+			ret = append(ret, mp)
+		}
+		up := p
+		up.Roles = lo.Without(p.Roles, publicRole)
+		if len(unmanagedTargets) > 0 && len(up.Roles) > 0 {
+			up.set(what, unmanagedTargets)
+			ret = append(ret, up)
+		}
+	}
+	return ret
+}
+
 // GenericPrivilege is a set of privileges for a set of roles on a set of targets.
 type GenericPrivilege struct {
 	Roles      []string `yaml:"roles,flow"`
@@ -163,7 +222,7 @@ func (gp *GenericPrivilege) set(what string, v []string) {
 }
 
 func fetchTablePrivileges(ctx context.Context, conn *pgx.Conn, database string, interestingUsers []string) ([]GenericPrivilege, []GenericPrivilege, error) {
-	rows, err := conn.Query(ctx, "SELECT pg_get_userbyid(grantee) AS grantee, nspname, relname, relkind, privilege_type, is_grantable FROM pg_catalog.pg_class, pg_namespace, aclexplode(relacl) WHERE pg_namespace.oid = relnamespace AND pg_get_userbyid(grantee) = ANY($1) AND nspname NOT IN ('pg_catalog', 'information_schema')", interestingUsers)
+	rows, err := conn.Query(ctx, "SELECT "+granteeName+" AS grantee, nspname, relname, relkind, privilege_type, is_grantable FROM pg_catalog.pg_class, pg_namespace, aclexplode(relacl) WHERE pg_namespace.oid = relnamespace AND "+granteeName+" = ANY($1) AND nspname NOT IN ('pg_catalog', 'information_schema')", interestingUsers)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -215,8 +274,88 @@ func fetchTablePrivileges(ctx context.Context, conn *pgx.Conn, database string,
 	return tables, sequences, nil
 }
 
+func fetchColumnPrivileges(ctx context.Context, conn *pgx.Conn, database string, interestingUsers []string) ([]GenericPrivilege, error) {
+	rows, err := conn.Query(ctx, "SELECT "+granteeName+" AS grantee, nspname, relname, attname, privilege_type, is_grantable FROM pg_catalog.pg_attribute, pg_class, pg_namespace, aclexplode(attacl) WHERE pg_class.oid = attrelid AND pg_namespace.oid = relnamespace AND attnum > 0 AND NOT attisdropped AND "+granteeName+" = ANY($1) AND nspname NOT IN ('pg_catalog', 'information_schema')", interestingUsers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	grouped := map[string]map[string]map[bool]privilegeSet{}
+	for rows.Next() {
+		var grantee, schema, table, column, privilege string
+		var grantable bool
+		if err := rows.Scan(&grantee, &schema, &table, &column, &privilege, &grantable); err != nil {
+			return nil, err
+		}
+		fqcn := joinColumnName(database, schema, table, column)
+		if grouped[grantee][fqcn] == nil {
+			if grouped[grantee] == nil {
+				grouped[grantee] = map[string]map[bool]privilegeSet{}
+			}
+			grouped[grantee][fqcn] = map[bool]privilegeSet{}
+		}
+		ps := grouped[grantee][fqcn][grantable]
+		ps.Add(privilege)
+		grouped[grantee][fqcn][grantable] = ps
+	}
+	var privs []GenericPrivilege
+	for grantee, tmp1 := range grouped {
+		for fqcn, tmp2 := range tmp1 {
+			for grantable, ps := range tmp2 {
+				privs = append(privs, GenericPrivilege{
+					Roles:      []string{grantee},
+					Columns:    []string{fqcn},
+					Privileges: ps.ListOrAll("columns"),
+					Grantable:  grantable,
+				})
+			}
+		}
+	}
+	return privs, nil
+}
+
+func fetchRoutinePrivileges(ctx context.Context, conn *pgx.Conn, database string, interestingUsers []string) ([]GenericPrivilege, error) {
+	rows, err := conn.Query(ctx, "SELECT nspname, proname, oidvectortypes(proargtypes), "+granteeName+" AS grantee, privilege_type, is_grantable FROM pg_catalog.pg_proc, pg_namespace, aclexplode(COALESCE(proacl, acldefault('f', proowner))) WHERE (proacl IS NOT NULL OR grantee = 0) AND pg_namespace.oid = pronamespace AND nspname NOT IN ('pg_catalog', 'information_schema') AND "+granteeName+" = ANY($1)", interestingUsers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	grouped := map[string]map[string]map[bool]privilegeSet{}
+	for rows.Next() {
+		var schema, routine, args, grantee, privilege string
+		var grantable bool
+		if err := rows.Scan(&schema, &routine, &args, &grantee, &privilege, &grantable); err != nil {
+			return nil, err
+		}
+		fqrn := joinRoutineName(database, schema, routine, args)
+		if grouped[grantee][fqrn] == nil {
+			if grouped[grantee] == nil {
+				grouped[grantee] = map[string]map[bool]privilegeSet{}
+			}
+			grouped[grantee][fqrn] = map[bool]privilegeSet{}
+		}
+		ps := grouped[grantee][fqrn][grantable]
+		ps.Add(privilege)
+		grouped[grantee][fqrn][grantable] = ps
+	}
+	var privs []GenericPrivilege
+	for grantee, tmp1 := range grouped {
+		for fqrn, tmp2 := range tmp1 {
+			for grantable, ps := range tmp2 {
+				privs = append(privs, GenericPrivilege{
+					Roles:      []string{grantee},
+					Routines:   []string{fqrn},
+					Privileges: ps.ListOrAll("routines"),
+					Grantable:  grantable,
+				})
+			}
+		}
+	}
+	return privs, nil
+}
+
 func fetchDatabasesPrivileges(ctx context.Context, conn *pgx.Conn, interestingUsers, interestingDatabases []string) ([]GenericPrivilege, error) {
-	rows, err := conn.Query(ctx, "SELECT datname, pg_get_userbyid(grantee) AS grantee, privilege_type, is_grantable FROM pg_catalog.pg_database, aclexplode(datacl) WHERE datallowconn AND datname = ANY($1) AND pg_get_userbyid(grantee) = ANY($2)", interestingDatabases, interestingUsers)
+	rows, err := conn.Query(ctx, "SELECT datname, "+granteeName+" AS grantee, privilege_type, is_grantable FROM pg_catalog.pg_database, aclexplode(COALESCE(datacl, acldefault('d', datdba))) WHERE (datacl IS NOT NULL OR grantee = 0) AND datallowconn AND datname = ANY($1) AND "+granteeName+" = ANY($2)", interestingDatabases, interestingUsers)
 	if err != nil {
 		return nil, err
 	}
@@ -254,8 +393,48 @@ func fetchDatabasesPrivileges(ctx context.Context, conn *pgx.Conn, interestingUs
 	return privs, nil
 }
 
+func fetchTablespacePrivileges(ctx context.Context, conn *pgx.Conn, interestingUsers []string) ([]GenericPrivilege, error) {
+	rows, err := conn.Query(ctx, "SELECT spcname, "+granteeName+" AS grantee, privilege_type, is_grantable FROM pg_catalog.pg_tablespace, aclexplode(spcacl) WHERE "+granteeName+" = ANY($1)", interestingUsers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	grouped := map[string]map[string]map[bool]privilegeSet{}
+	for rows.Next() {
+		var tablespace, grantee, privilege string
+		var grantable bool
+		if err := rows.Scan(&tablespace, &grantee, &privilege, &grantable); err != nil {
+			return nil, err
+		}
+		tablespace = safeIdentifier(tablespace)
+		if grouped[grantee][tablespace] == nil {
+			if grouped[grantee] == nil {
+				grouped[grantee] = map[string]map[bool]privilegeSet{}
+			}
+			grouped[grantee][tablespace] = map[bool]privilegeSet{}
+		}
+		ps := grouped[grantee][tablespace][grantable]
+		ps.Add(privilege)
+		grouped[grantee][tablespace][grantable] = ps
+	}
+	var privs []GenericPrivilege
+	for grantee, tmp1 := range grouped {
+		for tablespace, tmp2 := range tmp1 {
+			for grantable, ps := range tmp2 {
+				privs = append(privs, GenericPrivilege{
+					Roles:       []string{grantee},
+					Tablespaces: []string{tablespace},
+					Privileges:  ps.ListOrAll("tablespaces"),
+					Grantable:   grantable,
+				})
+			}
+		}
+	}
+	return privs, nil
+}
+
 func fetchSchemasPrivileges(ctx context.Context, conn *pgx.Conn, database string, interestingUsers []string) ([]GenericPrivilege, error) {
-	rows, err := conn.Query(ctx, "SELECT nspname, pg_get_userbyid(grantee) AS grantee, privilege_type, is_grantable FROM pg_catalog.pg_namespace, aclexplode(nspacl) WHERE nspname NOT IN ('pg_catalog', 'information_schema', 'pg_toast') AND pg_get_userbyid(grantee) = ANY($1)", interestingUsers)
+	rows, err := conn.Query(ctx, "SELECT nspname, "+granteeName+" AS grantee, privilege_type, is_grantable FROM pg_catalog.pg_namespace, aclexplode(nspacl) WHERE nspname NOT IN ('pg_catalog', 'information_schema', 'pg_toast') AND "+granteeName+" = ANY($1)", interestingUsers)
 	if err != nil {
 		return nil, err
 	}
@@ -295,7 +474,7 @@ func fetchSchemasPrivileges(ctx context.Context, conn *pgx.Conn, database string
 }
 
 func fetchTypePrivileges(ctx context.Context, conn *pgx.Conn, database string, interestingUsers []string) ([]GenericPrivilege, error) {
-	rows, err := conn.Query(ctx, "SELECT nspname, typname, pg_get_userbyid(grantee) AS grantee, privilege_type, is_grantable FROM pg_catalog.pg_type, pg_namespace, aclexplode(typacl) WHERE pg_namespace.oid = typnamespace AND nspname NOT IN ('pg_catalog', 'information_schema', 'pg_toast') AND pg_get_userbyid(grantee) = ANY($1)", interestingUsers)
+	rows, err := conn.Query(ctx, "SELECT nspname, typname, "+granteeName+" AS grantee, privilege_type, is_grantable FROM pg_catalog.pg_type, pg_namespace, aclexplode(COALESCE(typacl, acldefault('T', typowner))) WHERE (typacl IS NOT NULL OR (grantee = 0 AND typtype IN ('b', 'd', 'e', 'm', 'r') AND NOT (typtype = 'b' AND typcategory = 'A'))) AND pg_namespace.oid = typnamespace AND nspname NOT IN ('pg_catalog', 'information_schema', 'pg_toast') AND "+granteeName+" = ANY($1)", interestingUsers)
 	if err != nil {
 		return nil, err
 	}
@@ -335,7 +514,7 @@ func fetchTypePrivileges(ctx context.Context, conn *pgx.Conn, database string, i
 }
 
 func fetchLanguagePrivileges(ctx context.Context, conn *pgx.Conn, database string, interestingUsers []string) ([]GenericPrivilege, error) {
-	rows, err := conn.Query(ctx, "SELECT lanname, pg_get_userbyid(grantee) AS grantee, privilege_type, is_grantable FROM pg_catalog.pg_language, aclexplode(lanacl) WHERE pg_get_userbyid(grantee) = ANY($1)", interestingUsers)
+	rows, err := conn.Query(ctx, "SELECT lanname, "+granteeName+" AS grantee, privilege_type, is_grantable FROM pg_catalog.pg_language, aclexplode(COALESCE(lanacl, acldefault('l', lanowner))) WHERE (lanacl IS NOT NULL OR (grantee = 0 AND lanpltrusted)) AND "+granteeName+" = ANY($1)", interestingUsers)
 	if err != nil {
 		return nil, err
 	}
@@ -374,6 +553,126 @@ func fetchLanguagePrivileges(ctx context.Context, conn *pgx.Conn, database strin
 	return privs, nil
 }
 
+func fetchForeignDataWrapperPrivileges(ctx context.Context, conn *pgx.Conn, database string, interestingUsers []string) ([]GenericPrivilege, error) {
+	rows, err := conn.Query(ctx, "SELECT fdwname, "+granteeName+" AS grantee, privilege_type, is_grantable FROM pg_catalog.pg_foreign_data_wrapper, aclexplode(fdwacl) WHERE "+granteeName+" = ANY($1)", interestingUsers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	grouped := map[string]map[string]map[bool]privilegeSet{}
+	for rows.Next() {
+		var fdw, grantee, privilege string
+		var grantable bool
+		if err := rows.Scan(&fdw, &grantee, &privilege, &grantable); err != nil {
+			return nil, err
+		}
+		fqfn := joinSchemaName(database, fdw)
+		if grouped[grantee][fqfn] == nil {
+			if grouped[grantee] == nil {
+				grouped[grantee] = map[string]map[bool]privilegeSet{}
+			}
+			grouped[grantee][fqfn] = map[bool]privilegeSet{}
+		}
+		ps := grouped[grantee][fqfn][grantable]
+		ps.Add(privilege)
+		grouped[grantee][fqfn][grantable] = ps
+	}
+	var privs []GenericPrivilege
+	for grantee, tmp1 := range grouped {
+		for fqfn, tmp2 := range tmp1 {
+			for grantable, ps := range tmp2 {
+				privs = append(privs, GenericPrivilege{
+					Roles:               []string{grantee},
+					ForeignDataWrappers: []string{fqfn},
+					Privileges:          ps.ListOrAll("foreignDataWrappers"),
+					Grantable:           grantable,
+				})
+			}
+		}
+	}
+	return privs, nil
+}
+
+func fetchForeignServerPrivileges(ctx context.Context, conn *pgx.Conn, database string, interestingUsers []string) ([]GenericPrivilege, error) {
+	rows, err := conn.Query(ctx, "SELECT srvname, "+granteeName+" AS grantee, privilege_type, is_grantable FROM pg_catalog.pg_foreign_server, aclexplode(srvacl) WHERE "+granteeName+" = ANY($1)", interestingUsers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	grouped := map[string]map[string]map[bool]privilegeSet{}
+	for rows.Next() {
+		var server, grantee, privilege string
+		var grantable bool
+		if err := rows.Scan(&server, &grantee, &privilege, &grantable); err != nil {
+			return nil, err
+		}
+		fqsn := joinSchemaName(database, server)
+		if grouped[grantee][fqsn] == nil {
+			if grouped[grantee] == nil {
+				grouped[grantee] = map[string]map[bool]privilegeSet{}
+			}
+			grouped[grantee][fqsn] = map[bool]privilegeSet{}
+		}
+		ps := grouped[grantee][fqsn][grantable]
+		ps.Add(privilege)
+		grouped[grantee][fqsn][grantable] = ps
+	}
+	var privs []GenericPrivilege
+	for grantee, tmp1 := range grouped {
+		for fqsn, tmp2 := range tmp1 {
+			for grantable, ps := range tmp2 {
+				privs = append(privs, GenericPrivilege{
+					Roles:          []string{grantee},
+					ForeignServers: []string{fqsn},
+					Privileges:     ps.ListOrAll("foreignServers"),
+					Grantable:      grantable,
+				})
+			}
+		}
+	}
+	return privs, nil
+}
+
+func fetchLargeObjectPrivileges(ctx context.Context, conn *pgx.Conn, database string, interestingUsers []string) ([]GenericPrivilege, error) {
+	rows, err := conn.Query(ctx, "SELECT oid::text, "+granteeName+" AS grantee, privilege_type, is_grantable FROM pg_catalog.pg_largeobject_metadata, aclexplode(lomacl) WHERE "+granteeName+" = ANY($1)", interestingUsers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	grouped := map[string]map[string]map[bool]privilegeSet{}
+	for rows.Next() {
+		var oid, grantee, privilege string
+		var grantable bool
+		if err := rows.Scan(&oid, &grantee, &privilege, &grantable); err != nil {
+			return nil, err
+		}
+		fqon := database + "." + oid
+		if grouped[grantee][fqon] == nil {
+			if grouped[grantee] == nil {
+				grouped[grantee] = map[string]map[bool]privilegeSet{}
+			}
+			grouped[grantee][fqon] = map[bool]privilegeSet{}
+		}
+		ps := grouped[grantee][fqon][grantable]
+		ps.Add(privilege)
+		grouped[grantee][fqon][grantable] = ps
+	}
+	var privs []GenericPrivilege
+	for grantee, tmp1 := range grouped {
+		for fqon, tmp2 := range tmp1 {
+			for grantable, ps := range tmp2 {
+				privs = append(privs, GenericPrivilege{
+					Roles:        []string{grantee},
+					LargeObjects: []string{fqon},
+					Privileges:   ps.ListOrAll("largeObjects"),
+					Grantable:    grantable,
+				})
+			}
+		}
+	}
+	return privs, nil
+}
+
 type privilegeSet int
 
 func (ps *privilegeSet) Add(priv string) {
@@ -463,6 +762,10 @@ func applyPrivileges(ss SyncSink, database string, granting, justPrivs bool, dif
 	if len(diff) == 0 {
 		return
 	}
+	if diff[0].targets()[0] == "columns" {
+		applyColumnPrivileges(ss, database, granting, justPrivs, diff)
+		return
+	}
 	t := strings.ReplaceAll(strcase.ToScreamingSnake(strings.TrimSuffix(diff[0].targets()[0], "s")), "_", " ")
 	for _, n := range mergePrivileges(diff) {
 		var targets []string
@@ -477,18 +780,33 @@ func applyPrivileges(ss SyncSink, database string, granting, justPrivs bool, dif
 			continue
 		}
 		if granting {
-			q := "GRANT " + strings.Join(n.Privileges, ", ") + " ON " + t + " " + strings.Join(targets, ", ") + " TO " + strings.Join(n.Roles, ", ")
-			if n.Grantable {
-				q += " WITH GRANT OPTION"
-			}
-			ss.Query(database, q)
+			emit(ss, database, GrantPrivilege{ObjectType: t, Privileges: n.Privileges, Targets: targets, Roles: n.Roles, Grantable: n.Grantable})
 		} else {
-			q := "REVOKE "
-			if justPrivs {
-				q += "GRANT OPTION FOR "
+			emit(ss, database, RevokePrivilege{ObjectType: t, Privileges: n.Privileges, Targets: targets, Roles: n.Roles, GrantOptionOnly: justPrivs})
+		}
+	}
+}
+
+// applyColumnPrivileges is applyPrivileges for column privileges, which are granted on the table with a list of columns per privilege.
+func applyColumnPrivileges(ss SyncSink, database string, granting, justPrivs bool, diff []GenericPrivilege) {
+	for _, n := range mergePrivileges(diff) {
+		columnsPerTable := map[string][]string{}
+		for _, target := range n.untypedTargets() {
+			db, tgt := splitObjectName(target)
+			if db != database {
+				continue
+			}
+			table, columns := splitColumnName(tgt)
+			columnsPerTable[table] = append(columnsPerTable[table], columns...)
+		}
+		tables := lo.Keys(columnsPerTable)
+		sort.Strings(tables)
+		for _, table := range tables {
+			if granting {
+				emit(ss, database, GrantPrivilege{ObjectType: "TABLE", Privileges: n.Privileges, Columns: columnsPerTable[table], Targets: []string{table}, Roles: n.Roles, Grantable: n.Grantable})
+			} else {
+				emit(ss, database, RevokePrivilege{ObjectType: "TABLE", Privileges: n.Privileges, Columns: columnsPerTable[table], Targets: []string{table}, Roles: n.Roles, GrantOptionOnly: justPrivs})
 			}
-			q += strings.Join(n.Privileges, ", ") + " ON " + t + " " + strings.Join(targets, ", ") + " FROM " + strings.Join(n.Roles, ", ")
-			ss.Query(database, q)
 		}
 	}
 }
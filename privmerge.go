@@ -61,6 +61,8 @@ func mergePrivileges(input []GenericPrivilege) []GenericPrivilege {
 	// Unfold this back into a []GenericPrivilege.
 	var ret []GenericPrivilege
 	for gapsat, tar := range groupAll {
+		// Sort the roles so the generated queries are the same every time.
+		sort.Strings(tar.roles)
 		gp := GenericPrivilege{
 			Privileges: gapsat.privilegeSet.ListOrAll(t),
 			Grantable:  gapsat.grantable,
@@ -72,6 +74,28 @@ func mergePrivileges(input []GenericPrivilege) []GenericPrivilege {
 	return ret
 }
 
+// mergeColumns combines column privilege targets for the same table into a single target with a list of columns.
+func mergeColumns(input []GenericPrivilege) []GenericPrivilege {
+	for i, gp := range input {
+		var tables []string
+		columnsPerTable := map[string][]string{}
+		for _, t := range gp.Columns {
+			table, columns := splitColumnName(t)
+			if _, ok := columnsPerTable[table]; !ok {
+				tables = append(tables, table)
+			}
+			columnsPerTable[table] = append(columnsPerTable[table], columns...)
+		}
+		var targets []string
+		for _, table := range tables {
+			targets = append(targets, table+".("+strings.Join(columnsPerTable[table], ",")+")")
+		}
+		gp.Columns = targets
+		input[i] = gp
+	}
+	return input
+}
+
 type grantableAndPrivilegeSet struct {
 	grantable    bool
 	privilegeSet privilegeSet
@@ -4,27 +4,33 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v4"
 	"github.com/samber/lo"
+	"gopkg.in/yaml.v3"
 )
 
-// TODO: A config setting to manage all users (and thus not need to tombstone them) would be nice.
-
 // RoleAttributes is a piece of configuration that describes which attributes a role should have.
 type RoleAttributes struct {
-	Superuser       bool       `yaml:"superuser,omitempty"`
-	CreateDB        bool       `yaml:"createdb,omitempty"`
-	CreateRole      bool       `yaml:"createrole,omitempty"`
-	Inherit         *bool      `yaml:"inherit,omitempty"`
-	Login           *bool      `yaml:"login,omitempty"`
-	Replication     bool       `yaml:"replication,omitempty"`
-	BypassRLS       bool       `yaml:"bypassrls,omitempty"`
-	ConnectionLimit *int       `yaml:"connectionlimit,omitempty"`
-	Password        *string    `yaml:"password,omitempty"`
-	ValidUntil      *time.Time `yaml:"validuntil,omitempty"`
-	MemberOf        []string   `yaml:"member_of,omitempty"`
+	Superuser       bool         `yaml:"superuser,omitempty"`
+	CreateDB        bool         `yaml:"createdb,omitempty"`
+	CreateRole      bool         `yaml:"createrole,omitempty"`
+	Inherit         *bool        `yaml:"inherit,omitempty"`
+	Login           *bool        `yaml:"login,omitempty"`
+	Replication     bool         `yaml:"replication,omitempty"`
+	BypassRLS       bool         `yaml:"bypassrls,omitempty"`
+	ConnectionLimit *int         `yaml:"connectionlimit,omitempty"`
+	Password        *string      `yaml:"password,omitempty"`
+	ValidUntil      *time.Time   `yaml:"validuntil,omitempty"`
+	MemberOf        []Membership `yaml:"member_of,omitempty"`
+	// Settings are configuration parameters set for this role, like statement_timeout.
+	Settings map[string]string `yaml:"settings,omitempty"`
+	// DatabaseSettings are configuration parameters set for this role when connected to a specific database, keyed by database.
+	DatabaseSettings map[string]map[string]string `yaml:"database_settings,omitempty"`
 
 	// hashedPassword is precalculated (to fail early on) before syncing roles. If Password is already hashed, this'll be empty.
 	hashedPassword string
@@ -52,6 +58,84 @@ func (r RoleAttributes) GetValidUntil() time.Time {
 	return *r.ValidUntil
 }
 
+// Membership describes that a role is a member of another role. It can be written as just the name of the parent role or as an object.
+type Membership struct {
+	Role string `yaml:"role"`
+	// Admin is whether the member can grant membership of this role to others.
+	Admin bool `yaml:"admin_option,omitempty"`
+	// Inherit is whether the member inherits the privileges of this role. Requires PostgreSQL 16. If unset, it isn't managed.
+	Inherit *bool `yaml:"inherit_option,omitempty"`
+	// Set is whether the member can SET ROLE to this role. Requires PostgreSQL 16. If unset, it isn't managed.
+	Set *bool `yaml:"set_option,omitempty"`
+}
+
+type plainMembership Membership
+
+func (m *Membership) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*m = Membership{Role: value.Value}
+		return nil
+	}
+	return decodeStrict(value, (*plainMembership)(m))
+}
+
+func (m Membership) MarshalYAML() (interface{}, error) {
+	if !m.Admin && m.Inherit == nil && m.Set == nil {
+		return m.Role, nil
+	}
+	return plainMembership(m), nil
+}
+
+// TombstonedRole is a role that should be dropped. It can be written as just the name or as an object.
+type TombstonedRole struct {
+	Name string `yaml:"name"`
+	// ReassignTo is the role that gets ownership of all objects owned by this role before it is dropped. If set, the remaining privileges of this role are revoked as well.
+	ReassignTo string `yaml:"reassign_to,omitempty"`
+}
+
+type plainTombstonedRole TombstonedRole
+
+func (t *TombstonedRole) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*t = TombstonedRole{Name: value.Value}
+		return nil
+	}
+	return decodeStrict(value, (*plainTombstonedRole)(t))
+}
+
+func (t TombstonedRole) MarshalYAML() (interface{}, error) {
+	if t.ReassignTo == "" {
+		return t.Name, nil
+	}
+	return plainTombstonedRole(t), nil
+}
+
+func tombstonedRoleNames(tombstoned []TombstonedRole) []string {
+	ret := make([]string, len(tombstoned))
+	for i, t := range tombstoned {
+		ret[i] = t.Name
+	}
+	return ret
+}
+
+// grantOptions returns the WITH clause for GRANT role TO member, or an empty string if no options are needed.
+func (m Membership) grantOptions() string {
+	var opts []string
+	if m.Admin {
+		opts = append(opts, "ADMIN OPTION")
+	}
+	if m.Inherit != nil {
+		opts = append(opts, "INHERIT "+strings.ToUpper(strconv.FormatBool(*m.Inherit)))
+	}
+	if m.Set != nil {
+		opts = append(opts, "SET "+strings.ToUpper(strconv.FormatBool(*m.Set)))
+	}
+	if len(opts) == 0 {
+		return ""
+	}
+	return " WITH " + strings.Join(opts, ", ")
+}
+
 // CreateSQL returns the SQL to create this role.
 func (r RoleAttributes) CreateSQL(username string) string {
 	q := "CREATE ROLE " + username
@@ -123,105 +207,321 @@ func FetchRoles(ctx context.Context, conn *pgx.Conn) (map[string]RoleAttributes,
 		ret[rolname] = attr
 	}
 	rows.Close()
-	rows, err = conn.Query(ctx, "SELECT pg_get_userbyid(roleid), pg_get_userbyid(member) FROM pg_catalog.pg_auth_members")
+	version, err := serverVersion(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	q := "SELECT pg_get_userbyid(roleid), pg_get_userbyid(member), admin_option, true, true FROM pg_catalog.pg_auth_members"
+	if version >= 160000 {
+		// Since PostgreSQL 16 a role can be granted to the same member multiple times by different grantors. The member gets an option if any of those grants has it.
+		q = "SELECT pg_get_userbyid(roleid), pg_get_userbyid(member), bool_or(admin_option), bool_or(inherit_option), bool_or(set_option) FROM pg_catalog.pg_auth_members GROUP BY roleid, member"
+	}
+	rows, err = conn.Query(ctx, q)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var p, c string
-		if err := rows.Scan(&p, &c); err != nil {
+		var admin, inherit, set bool
+		if err := rows.Scan(&p, &c, &admin, &inherit, &set); err != nil {
 			return nil, err
 		}
 		if a, ok := ret[c]; ok {
-			a.MemberOf = append(a.MemberOf, p)
+			m := Membership{Role: p, Admin: admin}
+			if version >= 160000 {
+				// Only record the options if they differ from what a plain GRANT would've done.
+				if inherit != a.GetInherit() {
+					m.Inherit = lo.ToPtr(inherit)
+				}
+				if !set {
+					m.Set = lo.ToPtr(set)
+				}
+			}
+			a.MemberOf = append(a.MemberOf, m)
 			ret[c] = a
 		}
 	}
+	rows.Close()
+	rows, err = conn.Query(ctx, "SELECT pg_get_userbyid(setrole), COALESCE(datname, ''), setconfig FROM pg_catalog.pg_db_role_setting LEFT JOIN pg_catalog.pg_database ON pg_database.oid = setdatabase WHERE setrole != 0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rolname, database string
+		var config []string
+		if err := rows.Scan(&rolname, &database, &config); err != nil {
+			return nil, err
+		}
+		a, ok := ret[rolname]
+		if !ok {
+			continue
+		}
+		settings := map[string]string{}
+		for _, c := range config {
+			sp := strings.SplitN(c, "=", 2)
+			if len(sp) != 2 {
+				continue
+			}
+			settings[sp[0]] = sp[1]
+		}
+		if database == "" {
+			a.Settings = settings
+		} else {
+			if a.DatabaseSettings == nil {
+				a.DatabaseSettings = map[string]map[string]string{}
+			}
+			a.DatabaseSettings[database] = settings
+		}
+		ret[rolname] = a
+	}
 	return ret, nil
 }
 
+// listSettings are configuration parameters that take a list of identifiers. Their elements need to be quoted as identifiers rather than the value as a string.
+var listSettings = []string{"search_path", "temp_tablespaces", "local_preload_libraries", "session_preload_libraries", "shared_preload_libraries"}
+
+// settingValueSQL returns the value for a configuration parameter for use in ALTER ROLE ... SET.
+func settingValueSQL(name, value string) string {
+	if !lo.Contains(listSettings, name) {
+		return Escape(value)
+	}
+	return normalizeListSetting(value)
+}
+
+// normalizeListSetting returns the value of a list setting the way PostgreSQL stores it: separated by a comma and a space, and with only the elements quoted that need it.
+func normalizeListSetting(value string) string {
+	elems := strings.Split(value, ",")
+	for i, e := range elems {
+		e = strings.TrimSpace(e)
+		if len(e) >= 2 && strings.HasPrefix(e, `"`) && strings.HasSuffix(e, `"`) {
+			e = strings.ReplaceAll(e[1:len(e)-1], `""`, `"`)
+		}
+		elems[i] = safeIdentifier(e)
+	}
+	return strings.Join(elems, ", ")
+}
+
+// settingEqual returns whether two values of a configuration parameter are the same.
+func settingEqual(name, a, b string) bool {
+	if lo.Contains(listSettings, name) {
+		return normalizeListSetting(a) == normalizeListSetting(b)
+	}
+	return a == b
+}
+
+// syncSettings tells the SyncSink which queries should be executed to get the configuration parameters of a role (in a database) to the desired state.
+// The settings are passed in a stable order, sorted by name.
+func syncSettings(ss SyncSink, username, database string, o, n map[string]string) {
+	names := lo.Union(lo.Keys(n), lo.Keys(o))
+	sort.Strings(names)
+	for _, name := range names {
+		value, desired := n[name]
+		actual, found := o[name]
+		switch {
+		case !desired:
+			emit(ss, "", ResetRoleSetting{Role: username, Database: database, Name: name})
+		case !found || !settingEqual(name, actual, value):
+			emit(ss, "", SetRoleSetting{Role: username, Database: database, Name: name, Value: value})
+		}
+	}
+}
+
 func alterRole(ss SyncSink, username string, o, n RoleAttributes) {
-	q := ""
+	c := AlterRole{Name: username}
 	if n.Password != nil {
 		if *n.Password == "" {
 			if *o.Password != "" {
-				q += " PASSWORD NULL"
+				c.Password = n.Password
 			}
 		} else {
 			if !verifyPassword(*o.Password, username, *n.Password) {
 				if n.hashedPassword == "" {
 					n.hashedPassword = *n.Password
 				}
-				q += " PASSWORD " + Escape(n.hashedPassword)
+				c.Password = &n.hashedPassword
 			}
 		}
 	}
 	if o.GetConnectionLimit() != n.GetConnectionLimit() {
-		q += fmt.Sprintf(" CONNECTION LIMIT %d", n.GetConnectionLimit())
+		limit := n.GetConnectionLimit()
+		c.ConnectionLimit = &limit
 	}
 	if !o.GetValidUntil().Equal(n.GetValidUntil()) {
-		if n.GetValidUntil().IsZero() {
-			q += " VALID UNTIL 'infinity'"
-		} else {
-			q += " VALID UNTIL " + Escape(n.GetValidUntil().Format("2006-01-02T15:04:05Z"))
-		}
+		validUntil := n.GetValidUntil()
+		c.ValidUntil = &validUntil
 	}
 	type actualDesiredPriv struct {
-		name    string
+		field   **bool
 		actual  bool
 		desired bool
 	}
 	adps := []actualDesiredPriv{
-		{"SUPERUSER", o.Superuser, n.Superuser},
-		{"INHERIT", o.GetInherit(), n.GetInherit()},
-		{"CREATEROLE", o.CreateRole, n.CreateRole},
-		{"CREATEDB", o.CreateDB, n.CreateDB},
-		{"LOGIN", o.GetLogin(), n.GetLogin()},
-		{"REPLICATION", o.Replication, n.Replication},
-		{"BYPASSRLS", o.BypassRLS, n.BypassRLS},
+		{&c.Superuser, o.Superuser, n.Superuser},
+		{&c.Inherit, o.GetInherit(), n.GetInherit()},
+		{&c.CreateRole, o.CreateRole, n.CreateRole},
+		{&c.CreateDB, o.CreateDB, n.CreateDB},
+		{&c.Login, o.GetLogin(), n.GetLogin()},
+		{&c.Replication, o.Replication, n.Replication},
+		{&c.BypassRLS, o.BypassRLS, n.BypassRLS},
 	}
 	for _, adp := range adps {
 		if adp.actual == adp.desired {
 			continue
 		}
-		if adp.desired {
-			q += " " + adp.name
-		} else {
-			q += " NO" + adp.name
-		}
+		desired := adp.desired
+		*adp.field = &desired
 	}
-	if q != "" {
-		ss.Query("", "ALTER ROLE "+username+q)
+	if c != (AlterRole{Name: username}) {
+		emit(ss, "", c)
 	}
 }
 
 // SyncRoles tells the SyncSink which queries should be executed to get to the desired state.
-func SyncRoles(ss SyncSink, oldRoles, newRoles map[string]RoleAttributes, tombstoned []string) {
+// Objects owned by tombstoned roles with ReassignTo set are reassigned in each of the given databases before the role is dropped.
+func SyncRoles(ss SyncSink, oldRoles, newRoles map[string]RoleAttributes, tombstoned []TombstonedRole, databases []string) {
+	var reassign []TombstonedRole
 	for _, t := range tombstoned {
-		if _, found := oldRoles[t]; found {
-			ss.Query("", "DROP ROLE "+t)
+		if _, found := oldRoles[t.Name]; !found {
+			continue
 		}
+		if t.ReassignTo != "" {
+			reassign = append(reassign, t)
+			continue
+		}
+		emit(ss, "", DropRole{Name: t.Name})
 	}
-	for username, n := range newRoles {
+	// Iterate in a stable order, so ChangeSinks see the changes in the same order every time.
+	usernames := lo.Keys(newRoles)
+	sort.Strings(usernames)
+	for _, username := range usernames {
+		n := newRoles[username]
 		if o, found := oldRoles[username]; found {
 			alterRole(ss, username, o, n)
 		} else {
-			ss.Query("", n.CreateSQL(username))
+			emit(ss, "", CreateRole{Name: username, Attributes: n})
+		}
+	}
+	ss.AddBarrier()
+	// REASSIGN OWNED and DROP OWNED only affect the current database (and shared objects), so they need to be run in every database.
+	// The barriers are needed to prevent DROP OWNED from dropping the objects before they've been reassigned.
+	for _, t := range reassign {
+		for _, db := range databases {
+			emit(ss, db, ReassignOwned{Role: t.Name, NewOwner: t.ReassignTo})
+		}
+	}
+	ss.AddBarrier()
+	for _, t := range reassign {
+		for _, db := range databases {
+			emit(ss, db, DropOwned{Role: t.Name})
 		}
 	}
 	ss.AddBarrier()
-	for username, n := range newRoles {
-		o := oldRoles[username]
-		toRemove, toAdd := lo.Difference(o.MemberOf, n.MemberOf)
-		for _, parent := range toAdd {
-			ss.Query("", "GRANT "+parent+" TO "+username)
-		}
-		for _, parent := range toRemove {
-			if lo.Contains(tombstoned, parent) {
+	for _, t := range reassign {
+		emit(ss, "", DropRole{Name: t.Name})
+	}
+	tombstonedNames := tombstonedRoleNames(tombstoned)
+	for _, username := range usernames {
+		n, o := newRoles[username], oldRoles[username]
+		syncSettings(ss, username, "", o.Settings, n.Settings)
+		settingDatabases := lo.Union(lo.Keys(o.DatabaseSettings), lo.Keys(n.DatabaseSettings))
+		sort.Strings(settingDatabases)
+		for _, database := range settingDatabases {
+			syncSettings(ss, username, database, o.DatabaseSettings[database], n.DatabaseSettings[database])
+		}
+		syncMemberships(ss, username, o, n, tombstonedNames)
+	}
+}
+
+// bootstrapSuperuser returns the name of the role created by initdb, which can't be dropped.
+func bootstrapSuperuser(ctx context.Context, conn *pgx.Conn) (string, error) {
+	var name string
+	if err := conn.QueryRow(ctx, "SELECT rolname FROM pg_catalog.pg_authid WHERE oid = 10").Scan(&name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// unlistedRoles returns the existing roles that should be dropped because of manage_all_roles.
+// Roles in unmanaged, pg_* roles, the role we're connected as and the bootstrap superuser are never returned.
+func unlistedRoles(oldRoles, newRoles map[string]RoleAttributes, unmanaged []string, currentUser, bootstrapSuperuser string) []string {
+	var ret []string
+	for username := range oldRoles {
+		if _, found := newRoles[username]; found || lo.Contains(unmanaged, username) || strings.HasPrefix(username, "pg_") || username == currentUser || username == bootstrapSuperuser {
+			continue
+		}
+		ret = append(ret, username)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// checkMembershipOptions returns an error if any membership sets options that the server doesn't support.
+func checkMembershipOptions(roles map[string]RoleAttributes, serverVersion int) error {
+	if serverVersion >= 160000 {
+		return nil
+	}
+	var errs []string
+	for username, r := range roles {
+		for _, m := range r.MemberOf {
+			if m.Inherit != nil || m.Set != nil {
+				errs = append(errs, fmt.Sprintf("role %s: membership of %s sets inherit_option or set_option", username, m.Role))
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Strings(errs)
+	return fmt.Errorf("inherit_option and set_option need PostgreSQL 16 or newer, but the server is running %d: %s", serverVersion, strings.Join(errs, "; "))
+}
+
+// syncMemberships tells the SyncSink which queries should be executed to get the memberships of a role to the desired state.
+func syncMemberships(ss SyncSink, username string, o, n RoleAttributes, tombstoned []string) {
+	actual := map[string]Membership{}
+	for _, m := range o.MemberOf {
+		actual[m.Role] = m
+	}
+	desired := map[string]Membership{}
+	for _, m := range n.MemberOf {
+		desired[m.Role] = m
+		a, found := actual[m.Role]
+		if !found {
+			emit(ss, "", GrantMembership{Role: m.Role, Member: username, Admin: m.Admin, Inherit: m.Inherit, Set: m.Set})
+			continue
+		}
+		if m.Admin && !a.Admin {
+			emit(ss, "", GrantMembership{Role: m.Role, Member: username, Admin: true})
+		} else if !m.Admin && a.Admin {
+			emit(ss, "", RevokeMembership{Role: m.Role, Member: username, Option: "ADMIN"})
+		}
+		type actualDesiredOption struct {
+			name    string
+			actual  bool
+			desired *bool
+		}
+		ados := []actualDesiredOption{
+			{"INHERIT", a.Inherit == nil && o.GetInherit() || a.Inherit != nil && *a.Inherit, m.Inherit},
+			{"SET", a.Set == nil || *a.Set, m.Set},
+		}
+		for _, ado := range ados {
+			if ado.desired == nil || ado.actual == *ado.desired {
 				continue
 			}
-			ss.Query("", "REVOKE "+parent+" FROM "+username)
+			if !*ado.desired {
+				emit(ss, "", RevokeMembership{Role: m.Role, Member: username, Option: ado.name})
+			} else if ado.name == "INHERIT" {
+				emit(ss, "", GrantMembership{Role: m.Role, Member: username, Inherit: ado.desired})
+			} else {
+				emit(ss, "", GrantMembership{Role: m.Role, Member: username, Set: ado.desired})
+			}
+		}
+	}
+	for _, m := range o.MemberOf {
+		if _, found := desired[m.Role]; found || lo.Contains(tombstoned, m.Role) {
+			continue
 		}
+		emit(ss, "", RevokeMembership{Role: m.Role, Member: username})
 	}
 }
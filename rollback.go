@@ -0,0 +1,210 @@
+package pgperms
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// syncRollback tells the SyncSink which queries undo the changes made by syncing desired onto actual.
+// It works by syncing the other way around: from the state after the sync back to actual, as gathered before the sync.
+// It returns a description of every change that can't be undone, like dropping a database.
+func syncRollback(ss SyncSink, actual, desired *Config, tombstonedRoles []TombstonedRole, tombstonedDatabases []TombstonedDatabase, tombstonedSchemas []string, serverVersion int) []string {
+	var irreversible []string
+	for _, d := range tombstonedDatabases {
+		if lo.Contains(databaseNames(actual.Databases), d.Name) {
+			irreversible = append(irreversible, "DROP DATABASE "+safeIdentifier(d.Name)+": the database and its contents can't be restored")
+		}
+	}
+	for _, s := range tombstonedSchemas {
+		if lo.Contains(schemaNames(actual.Schemas), s) {
+			irreversible = append(irreversible, "DROP SCHEMA "+s+": the schema and its contents can't be restored")
+		}
+	}
+	droppedRoles := map[string]RoleAttributes{}
+	for _, t := range tombstonedRoles {
+		r, found := actual.Roles[t.Name]
+		if !found {
+			continue
+		}
+		droppedRoles[t.Name] = r
+		if t.ReassignTo != "" {
+			irreversible = append(irreversible, "REASSIGN OWNED BY "+t.Name+" TO "+t.ReassignTo+": the objects stay owned by "+t.ReassignTo)
+		}
+		irreversible = append(irreversible, "DROP ROLE "+t.Name+": the role is recreated, but its privileges aren't restored")
+	}
+	sort.Strings(irreversible)
+
+	// before and after hold the roles as they are before and after the sync.
+	before := map[string]RoleAttributes{}
+	after := map[string]RoleAttributes{}
+	var created []TombstonedRole
+	createdRoles := map[string]RoleAttributes{}
+	for username, n := range desired.Roles {
+		o, found := actual.Roles[username]
+		if !found {
+			created = append(created, TombstonedRole{Name: username})
+			createdRoles[username] = n
+			continue
+		}
+		before[username], after[username] = roleBeforeAndAfter(o, n)
+	}
+	for username, r := range droppedRoles {
+		before[username] = r
+	}
+	SyncRoles(ss, after, before, nil, nil)
+	ss.AddBarrier()
+
+	var databasesBefore, databasesAfter []DatabaseDefinition
+	for _, o := range actual.Databases {
+		for _, n := range desired.Databases {
+			if n.Name == o.Name {
+				b, a := databaseBeforeAndAfter(o, n)
+				databasesBefore = append(databasesBefore, b)
+				databasesAfter = append(databasesAfter, a)
+			}
+		}
+	}
+	SyncDatabaseAttributes(ss, databasesBefore, databasesAfter)
+	ss.AddBarrier()
+	databases := databaseNames(desired.Databases)
+	SyncPrivileges(ss, []string{""}, desired.DatabasePrivileges, actual.DatabasePrivileges)
+	ss.AddBarrier()
+	SyncPrivileges(ss, []string{""}, desired.TablespacePrivileges, actual.TablespacePrivileges)
+	ss.AddBarrier()
+	var schemasBefore, schemasAfter []SchemaDefinition
+	for _, o := range actual.Schemas {
+		for _, n := range desired.Schemas {
+			if n.Name == o.Name {
+				if n.Owner == "" {
+					n.Owner = o.Owner
+				}
+				schemasBefore = append(schemasBefore, o)
+				schemasAfter = append(schemasAfter, n)
+			}
+		}
+	}
+	SyncSchemaOwners(ss, schemasBefore, schemasAfter)
+	ss.AddBarrier()
+	SyncOwnership(ss, desired.Ownership, actual.Ownership)
+	ss.AddBarrier()
+	sections := actual.genericPrivileges()
+	for i, d := range desired.genericPrivileges() {
+		if d == &desired.DatabasePrivileges || d == &desired.TablespacePrivileges {
+			continue
+		}
+		SyncPrivileges(ss, databases, *d, *sections[i])
+		ss.AddBarrier()
+	}
+	SyncDefaultPrivileges(ss, desired.DefaultPrivileges, actual.DefaultPrivileges)
+	ss.AddBarrier()
+
+	// Drop everything that was created, now that nothing refers to it anymore.
+	var createdSchemas []string
+	for _, s := range desired.Schemas {
+		if !lo.Contains(schemaNames(actual.Schemas), s.Name) {
+			createdSchemas = append(createdSchemas, s.Name)
+		}
+	}
+	SyncSchemas(ss, nil, createdSchemas, desired.Schemas)
+	ss.AddBarrier()
+	var createdDatabases []TombstonedDatabase
+	for _, d := range desired.Databases {
+		if !lo.Contains(databaseNames(actual.Databases), d.Name) {
+			createdDatabases = append(createdDatabases, TombstonedDatabase{Name: d.Name})
+		}
+	}
+	SyncDatabases(ss, nil, createdDatabases, desired.Databases, serverVersion)
+	ss.AddBarrier()
+	SyncRoles(ss, createdRoles, nil, created, nil)
+	return irreversible
+}
+
+// roleBeforeAndAfter returns the attributes of a role before and after syncing it from o to n.
+// Attributes that n leaves alone are copied from o, and membership options that n sets are made explicit in o, so that syncing back restores them.
+func roleBeforeAndAfter(o, n RoleAttributes) (RoleAttributes, RoleAttributes) {
+	switch {
+	case n.Password == nil:
+		n.Password = o.Password
+	case n.hashedPassword != "":
+		n.Password = &n.hashedPassword
+	}
+	n.hashedPassword = ""
+	actual := map[string]Membership{}
+	for _, m := range o.MemberOf {
+		actual[m.Role] = m
+	}
+	n.MemberOf = append([]Membership(nil), n.MemberOf...)
+	for i, m := range n.MemberOf {
+		a, found := actual[m.Role]
+		if !found {
+			continue
+		}
+		if m.Inherit == nil {
+			n.MemberOf[i].Inherit = a.Inherit
+		} else if a.Inherit == nil {
+			a.Inherit = lo.ToPtr(o.GetInherit())
+		}
+		if m.Set == nil {
+			n.MemberOf[i].Set = a.Set
+		} else if a.Set == nil {
+			a.Set = lo.ToPtr(true)
+		}
+		actual[m.Role] = a
+	}
+	memberOf := make([]Membership, len(o.MemberOf))
+	for i, m := range o.MemberOf {
+		memberOf[i] = actual[m.Role]
+	}
+	o.MemberOf = memberOf
+	return o, n
+}
+
+// databaseBeforeAndAfter returns the definition of a database before and after syncing it from o to n, with all attributes that SyncDatabaseAttributes changes set explicitly.
+func databaseBeforeAndAfter(o, n DatabaseDefinition) (DatabaseDefinition, DatabaseDefinition) {
+	if n.Owner == "" {
+		n.Owner = o.Owner
+	}
+	if n.ConnectionLimit == nil {
+		n.ConnectionLimit = lo.ToPtr(o.GetConnectionLimit())
+	}
+	if n.AllowConnections == nil {
+		n.AllowConnections = lo.ToPtr(o.GetAllowConnections())
+	}
+	if n.IsTemplate == nil {
+		n.IsTemplate = lo.ToPtr(o.GetIsTemplate())
+	}
+	o.ConnectionLimit = lo.ToPtr(o.GetConnectionLimit())
+	o.AllowConnections = lo.ToPtr(o.GetAllowConnections())
+	o.IsTemplate = lo.ToPtr(o.GetIsTemplate())
+	return o, n
+}
+
+// RollbackScript returns a psql script that undoes the queries of the plan, with a comment listing the changes it can't undo.
+// It should be run with psql connected to the same database as pgperms was.
+func (p *Plan) RollbackScript() string {
+	var sb strings.Builder
+	sb.WriteString("-- Generated by pgperms to undo a plan.\n")
+	if len(p.Irreversible) > 0 {
+		sb.WriteString("-- These changes can't be undone:\n")
+		for _, s := range p.Irreversible {
+			sb.WriteString("--   " + s + "\n")
+		}
+	}
+	sb.WriteString("\\set ON_ERROR_STOP on\n")
+	sb.WriteString("\\set pgperms_initial_database :DBNAME\n")
+	current := ""
+	for _, q := range p.Rollback {
+		if q.Database != current {
+			if q.Database == "" {
+				sb.WriteString("\\connect :pgperms_initial_database\n")
+			} else {
+				sb.WriteString("\\connect " + safeIdentifier(q.Database) + "\n")
+			}
+			current = q.Database
+		}
+		sb.WriteString(q.Query + ";\n")
+	}
+	return sb.String()
+}
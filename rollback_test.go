@@ -0,0 +1,74 @@
+package pgperms
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/samber/lo"
+)
+
+func TestRollback(t *testing.T) {
+	oldHash := "SCRAM-SHA-256$4096:ICus8JAbG67BUVc+bifCBg==$3ULFbqx6ySVZJr51b6DOVQIbqy3GxrsHyxb/+JD0pag=:TJyct6ApBeiTdr+z7RP8CXtTOO5w+iK3NEervm9Ezb0="
+	actual := &Config{
+		Roles: map[string]RoleAttributes{
+			"alice": {Superuser: true, Password: &oldHash, MemberOf: []Membership{{Role: "staff"}}},
+			"bob":   {Password: new(string), MemberOf: []Membership{{Role: "staff"}}},
+			"staff": {Password: new(string)},
+		},
+		Databases: []DatabaseDefinition{{Name: "app", Owner: "postgres"}},
+		TablePrivileges: []GenericPrivilege{
+			{Roles: []string{"alice"}, Privileges: []string{"DELETE"}, Tables: []string{"app.public.t"}},
+		},
+	}
+	desired := &Config{
+		Roles: map[string]RoleAttributes{
+			"alice": {Password: lo.ToPtr("md5c4b2d1a1a8f8d8c23d3a51f1e8a7b3f0"), MemberOf: []Membership{{Role: "staff", Admin: true}}},
+			"carol": {},
+			"staff": {},
+		},
+		Databases: []DatabaseDefinition{{Name: "app", Owner: "alice", ConnectionLimit: lo.ToPtr(10)}, {Name: "new"}},
+		TablePrivileges: []GenericPrivilege{
+			{Roles: []string{"alice", "carol"}, Privileges: []string{"SELECT"}, Tables: []string{"app.public.t"}},
+		},
+	}
+	rec := NewRecorder()
+	irreversible := syncRollback(rec, actual, desired, []TombstonedRole{{Name: "bob", ReassignTo: "alice"}}, nil, nil, 160000)
+
+	wantIrreversible := []string{
+		"DROP ROLE bob: the role is recreated, but its privileges aren't restored",
+		"REASSIGN OWNED BY bob TO alice: the objects stay owned by alice",
+	}
+	if diff := cmp.Diff(wantIrreversible, irreversible); diff != "" {
+		t.Errorf("syncRollback returned different irreversible changes (-want +got): %s", diff)
+	}
+	want := []QueryForDatabase{
+		{"", "ALTER ROLE alice PASSWORD '" + oldHash + "' SUPERUSER"},
+		{"", "CREATE ROLE bob LOGIN"},
+		{"", "GRANT staff TO bob"},
+		{"", "REVOKE ADMIN OPTION FOR staff FROM alice"},
+		{"", "ALTER DATABASE app CONNECTION LIMIT -1"},
+		{"", "ALTER DATABASE app OWNER TO postgres"},
+		{"app", "GRANT DELETE ON TABLE public.t TO alice"},
+		{"app", "REVOKE SELECT ON TABLE public.t FROM alice, carol"},
+		{"", "DROP DATABASE new"},
+		{"", "DROP ROLE carol"},
+	}
+	if diff := cmp.Diff(want, rec.Get()); diff != "" {
+		t.Errorf("syncRollback returned different queries (-want +got): %s", diff)
+	}
+
+	p := &Plan{Rollback: want[5:8], Irreversible: wantIrreversible[:1]}
+	wantScript := `-- Generated by pgperms to undo a plan.
+-- These changes can't be undone:
+--   DROP ROLE bob: the role is recreated, but its privileges aren't restored
+\set ON_ERROR_STOP on
+\set pgperms_initial_database :DBNAME
+ALTER DATABASE app OWNER TO postgres;
+\connect app
+GRANT DELETE ON TABLE public.t TO alice;
+REVOKE SELECT ON TABLE public.t FROM alice, carol;
+`
+	if diff := cmp.Diff(wantScript, p.RollbackScript()); diff != "" {
+		t.Errorf("RollbackScript() returned a diff (-want +got): %s", diff)
+	}
+}
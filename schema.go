@@ -1,30 +1,85 @@
 package pgperms
 
+import (
+	"bytes"
+
+	"gopkg.in/yaml.v3"
+)
+
 // Config is the YAML format.
 type Config struct {
 	IgnoreSuperuserGrants *bool `yaml:"ignore_superuser_grants,omitempty"`
 
 	Roles               map[string]RoleAttributes
-	TombstonedRoles     []string `yaml:"tombstoned_roles,omitempty"`
-	Databases           []string
-	TombstonedDatabases []string `yaml:"tombstoned_databases,omitempty"`
-	Schemas             []string
+	TombstonedRoles     []TombstonedRole `yaml:"tombstoned_roles,omitempty"`
+	ManageAllRoles      bool             `yaml:"manage_all_roles,omitempty"`
+	UnmanagedRoles      []string         `yaml:"unmanaged_roles,omitempty"`
+	Databases           []DatabaseDefinition
+	TombstonedDatabases []TombstonedDatabase `yaml:"tombstoned_databases,omitempty"`
+	ManageAllDatabases  bool                 `yaml:"manage_all_databases,omitempty"`
+	UnmanagedDatabases  []string             `yaml:"unmanaged_databases,omitempty"`
+	Schemas             []SchemaDefinition
 	TombstonedSchemas   []string `yaml:"tombstoned_schemas,omitempty"`
+	ManageAllSchemas    bool     `yaml:"manage_all_schemas,omitempty"`
+	UnmanagedSchemas    []string `yaml:"unmanaged_schemas,omitempty"`
+
+	DatabasePrivileges           []GenericPrivilege `yaml:"database_privileges,omitempty"`
+	SchemaPrivileges             []GenericPrivilege `yaml:"schema_privileges,omitempty"`
+	TablePrivileges              []GenericPrivilege `yaml:"table_privileges,omitempty"`
+	SequencePrivileges           []GenericPrivilege `yaml:"sequence_privileges,omitempty"`
+	ColumnPrivileges             []GenericPrivilege `yaml:"column_privileges,omitempty"`
+	ForeignDataWrapperPrivileges []GenericPrivilege `yaml:"foreign_data_wrapper_privileges,omitempty"`
+	ForeignServerPrivileges      []GenericPrivilege `yaml:"foreign_server_privileges,omitempty"`
+	RoutinePrivileges            []GenericPrivilege `yaml:"routine_privileges,omitempty"`
+	LanguagePrivileges           []GenericPrivilege `yaml:"language_privileges,omitempty"`
+	LargeObjectPrivileges        []GenericPrivilege `yaml:"large_object_privileges,omitempty"`
+	TablespacePrivileges         []GenericPrivilege `yaml:"tablespace_privileges,omitempty"`
+	TypePrivileges               []GenericPrivilege `yaml:"type_privileges,omitempty"`
 
-	DatabasePrivileges []GenericPrivilege `yaml:"database_privileges,omitempty"`
-	SchemaPrivileges   []GenericPrivilege `yaml:"schema_privileges,omitempty"`
-	TablePrivileges    []GenericPrivilege `yaml:"table_privileges,omitempty"`
-	SequencePrivileges []GenericPrivilege `yaml:"sequence_privileges,omitempty"`
-	// ColumnPrivileges             []GenericPrivilege `yaml:"column_privileges,omitempty"`
-	// ForeignDataWrapperPrivileges []GenericPrivilege `yaml:"foreign_data_wrapper_privileges,omitempty"`
-	// ForeignServerPrivileges      []GenericPrivilege `yaml:"foreign_server_privileges,omitempty"`
-	// RoutinePrivileges            []GenericPrivilege `yaml:"routine_privileges,omitempty"`
-	LanguagePrivileges []GenericPrivilege `yaml:"language_privileges,omitempty"`
-	// LargeObjectPrivileges        []GenericPrivilege `yaml:"large_object_privileges,omitempty"`
-	// TablespacePrivileges         []GenericPrivilege `yaml:"tablespace_privileges,omitempty"`
-	TypePrivileges []GenericPrivilege `yaml:"type_privileges,omitempty"`
+	DefaultPrivileges []DefaultPrivilege `yaml:"default_privileges,omitempty"`
+
+	Ownership []Ownership `yaml:"ownership,omitempty"`
 }
 
 func (c Config) GetIgnoreSuperuserGrants() bool {
 	return c.IgnoreSuperuserGrants == nil || *c.IgnoreSuperuserGrants
 }
+
+// decodeStrict decodes a yaml node into v, rejecting unknown fields like the decoder in Sync does.
+func decodeStrict(node *yaml.Node, v interface{}) error {
+	b, err := yaml.Marshal(node)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	return dec.Decode(v)
+}
+
+// genericPrivileges returns pointers to all sections of GenericPrivileges, always in the same order.
+func (c *Config) genericPrivileges() []*[]GenericPrivilege {
+	return []*[]GenericPrivilege{
+		&c.DatabasePrivileges,
+		&c.SchemaPrivileges,
+		&c.TablePrivileges,
+		&c.SequencePrivileges,
+		&c.ColumnPrivileges,
+		&c.ForeignDataWrapperPrivileges,
+		&c.ForeignServerPrivileges,
+		&c.RoutinePrivileges,
+		&c.LanguagePrivileges,
+		&c.LargeObjectPrivileges,
+		&c.TablespacePrivileges,
+		&c.TypePrivileges,
+	}
+}
+
+// mentionsPublic returns whether PUBLIC is used as a grantee anywhere in the config.
+func (c *Config) mentionsPublic() bool {
+	for _, privs := range c.genericPrivileges() {
+		if mentionsPublic(*privs) {
+			return true
+		}
+	}
+	return len(defaultPrivilegesPublicKeys(c.DefaultPrivileges)) > 0
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sort"
+	"strings"
 )
 
 // SyncSink will be called for every query that should be executed to get to the desired state.
@@ -22,43 +23,64 @@ func NewRecorder() *Recorder {
 }
 
 // Recorder is a SyncSink that simply records all the queries.
+// It also implements ChangeSink, so it can describe what each query does (see Operations).
 type Recorder struct {
-	queries []QueryForDatabase
-	barrier int
+	operations []Operation
+	barrier    int
 }
 
 type QueryForDatabase struct {
-	Database string
-	Query    string
+	Database string `json:"database"`
+	Query    string `json:"query"`
 }
 
 func (q QueryForDatabase) String() string {
 	return fmt.Sprintf("/* %24s */ %s", q.Database, q.Query)
 }
 
-var _ SyncSink = &Recorder{}
+var _ ChangeSink = &Recorder{}
 
-// Query records that a query should happen.
+// Query records that a query should happen. Its Operation will have kind "other".
 func (r *Recorder) Query(database, query string) {
-	r.queries = append(r.queries, QueryForDatabase{database, query})
+	r.operations = append(r.operations, Operation{Database: database, SQL: query, Kind: "other"})
+}
+
+// Change records the query for a change, along with a description of what it does.
+func (r *Recorder) Change(database string, c Change) {
+	r.operations = append(r.operations, changeOperation(database, c))
 }
 
 func (r *Recorder) AddBarrier() {
-	s := r.queries[r.barrier:]
+	s := r.operations[r.barrier:]
 	sort.Slice(s, func(i, j int) bool {
-		return s[i].Query < s[j].Query
+		if s[i].SQL == s[j].SQL {
+			return s[i].Database < s[j].Database
+		}
+		return s[i].SQL < s[j].SQL
 	})
-	r.barrier = len(r.queries)
+	r.barrier = len(r.operations)
 }
 
 // Get returns all queries recorded by this Recorder.
 func (r *Recorder) Get() []QueryForDatabase {
+	ops := r.Operations()
+	ret := make([]QueryForDatabase, len(ops))
+	for i, op := range ops {
+		ret[i] = QueryForDatabase{op.Database, op.SQL}
+	}
+	return ret
+}
+
+// Operations returns a description of all queries recorded by this Recorder, in the same order as Get.
+func (r *Recorder) Operations() []Operation {
 	r.AddBarrier()
-	return r.queries
+	return r.operations
 }
 
 func (r *Recorder) Apply(ctx context.Context, conns *Connections) error {
-	for _, q := range r.Get() {
+	qs := r.Get()
+	disconnectFromDroppedDatabases(conns, qs)
+	for _, q := range qs {
 		db, deref, err := conns.Get(q.Database)
 		if err != nil {
 			return fmt.Errorf("failed to connect to database %q: %v", q.Database, err)
@@ -71,3 +93,117 @@ func (r *Recorder) Apply(ctx context.Context, conns *Connections) error {
 	}
 	return nil
 }
+
+// disconnectFromDroppedDatabases closes our idle connections if any of the queries drops a database, because a database can't be dropped while we're connected to it.
+// This is done right before applying the queries, so that planning doesn't need to reconnect.
+func disconnectFromDroppedDatabases(conns *Connections, qs []QueryForDatabase) {
+	for _, q := range qs {
+		if strings.HasPrefix(q.Query, "DROP DATABASE ") {
+			conns.dropIdleConnections()
+			return
+		}
+	}
+}
+
+// runsInTransaction returns whether the query is allowed inside a transaction block.
+func (q QueryForDatabase) runsInTransaction() bool {
+	return !strings.HasPrefix(q.Query, "CREATE DATABASE ") && !strings.HasPrefix(q.Query, "DROP DATABASE ")
+}
+
+// TransactionResult describes what happened to a group of queries applied by ApplyTransactional.
+type TransactionResult struct {
+	// Database is where the queries were run. An empty string means the queries could be run on any database.
+	Database string
+	// Transactional is false for the queries that can't run inside a transaction (like CREATE DATABASE). Those are run one by one.
+	Transactional bool
+	Queries       []QueryForDatabase
+	// Committed is whether all queries were executed successfully.
+	Committed bool
+	Err       error
+}
+
+// transactionGroups splits the recorded queries into groups that are each run in their own transaction.
+// The first group has all queries up to the last one that can't run in a transaction. The rest is split into spans of queries that run on any database and spans of queries that run on specific databases, and those spans are grouped by database.
+func (r *Recorder) transactionGroups() []TransactionResult {
+	qs := r.Get()
+	last := -1
+	for i, q := range qs {
+		if !q.runsInTransaction() {
+			last = i
+		}
+	}
+	var groups []TransactionResult
+	if last >= 0 {
+		groups = append(groups, TransactionResult{Queries: qs[:last+1]})
+	}
+	var span map[string]int
+	var globalSpan bool
+	for _, q := range qs[last+1:] {
+		if global := q.Database == ""; span == nil || global != globalSpan {
+			// Queries for any database (like creating roles) need to be committed before queries in specific databases can use them, and vice versa.
+			span = map[string]int{}
+			globalSpan = global
+		}
+		i, ok := span[q.Database]
+		if !ok {
+			groups = append(groups, TransactionResult{Database: q.Database, Transactional: true})
+			i = len(groups) - 1
+			span[q.Database] = i
+		}
+		groups[i].Queries = append(groups[i].Queries, q)
+	}
+	return groups
+}
+
+// ApplyTransactional executes the recorded queries, running the queries for each database inside a transaction.
+// Queries that can't run inside a transaction are run first. It stops at the first failing transaction, which is rolled back.
+// The returned results describe every group of queries that was attempted, so callers can report which ones were committed.
+func (r *Recorder) ApplyTransactional(ctx context.Context, conns *Connections) ([]TransactionResult, error) {
+	var results []TransactionResult
+	disconnectFromDroppedDatabases(conns, r.Get())
+	for _, g := range r.transactionGroups() {
+		g.Err = g.apply(ctx, conns)
+		g.Committed = g.Err == nil
+		results = append(results, g)
+		if g.Err != nil {
+			return results, g.Err
+		}
+	}
+	return results, nil
+}
+
+func (g TransactionResult) apply(ctx context.Context, conns *Connections) error {
+	if !g.Transactional {
+		for _, q := range g.Queries {
+			db, deref, err := conns.Get(q.Database)
+			if err != nil {
+				return fmt.Errorf("failed to connect to database %q: %v", q.Database, err)
+			}
+			_, err = db.Exec(ctx, q.Query)
+			deref()
+			if err != nil {
+				return fmt.Errorf("query %q on database %q failed: %v", q.Query, q.Database, err)
+			}
+		}
+		return nil
+	}
+	db, deref, err := conns.Get(g.Database)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database %q: %v", g.Database, err)
+	}
+	defer deref()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start a transaction on database %q: %v", g.Database, err)
+	}
+	defer tx.Rollback(ctx)
+	for _, q := range g.Queries {
+		if _, err := tx.Exec(ctx, q.Query); err != nil {
+			return fmt.Errorf("query %q on database %q failed (transaction rolled back): %v", q.Query, q.Database, err)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction on database %q: %v", g.Database, err)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package pgperms
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestTransactionGroups(t *testing.T) {
+	r := NewRecorder()
+	r.Query("", "CREATE DATABASE newdb")
+	r.AddBarrier()
+	r.Query("", "CREATE ROLE newrole")
+	r.AddBarrier()
+	r.Query("db1", "REASSIGN OWNED BY oldrole TO newrole")
+	r.Query("db2", "REASSIGN OWNED BY oldrole TO newrole")
+	r.AddBarrier()
+	r.Query("db1", "DROP OWNED BY oldrole")
+	r.AddBarrier()
+	r.Query("", "DROP ROLE oldrole")
+	r.AddBarrier()
+	r.Query("newdb", "CREATE SCHEMA app")
+	r.Query("db1", "GRANT USAGE ON SCHEMA app TO newrole")
+
+	want := []TransactionResult{
+		{Database: "", Transactional: false, Queries: []QueryForDatabase{{"", "CREATE DATABASE newdb"}}},
+		{Database: "", Transactional: true, Queries: []QueryForDatabase{{"", "CREATE ROLE newrole"}}},
+		{Database: "db1", Transactional: true, Queries: []QueryForDatabase{{"db1", "REASSIGN OWNED BY oldrole TO newrole"}, {"db1", "DROP OWNED BY oldrole"}}},
+		{Database: "db2", Transactional: true, Queries: []QueryForDatabase{{"db2", "REASSIGN OWNED BY oldrole TO newrole"}}},
+		{Database: "", Transactional: true, Queries: []QueryForDatabase{{"", "DROP ROLE oldrole"}}},
+		{Database: "newdb", Transactional: true, Queries: []QueryForDatabase{{"newdb", "CREATE SCHEMA app"}}},
+		{Database: "db1", Transactional: true, Queries: []QueryForDatabase{{"db1", "GRANT USAGE ON SCHEMA app TO newrole"}}},
+	}
+	if diff := cmp.Diff(want, r.transactionGroups(), cmpopts.EquateErrors()); diff != "" {
+		t.Errorf("transactionGroups() returned a diff (-want +got): %s", diff)
+	}
+}
@@ -2,6 +2,9 @@ package pgperms
 
 import (
 	"fmt"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/Jille/genericz/slicez"
@@ -10,6 +13,9 @@ import (
 
 // TODO: Do we want to raise warnings for likely incorrect configurations? (RoleAttributes.Replication without RoleAttributes.Login etc)
 
+// databaseLevelObjects are the types of objects that live directly in a database rather than in a schema.
+var databaseLevelObjects = []string{"languages", "foreignDataWrappers", "foreignServers", "largeObjects"}
+
 type validator struct {
 	tombstonedRoles     []string
 	definedRoles        []string
@@ -18,31 +24,66 @@ type validator struct {
 	tombstonedSchemas   []string
 	definedSchemas      []string
 
+	// unconnectableDatabases are the databases with allow_connections set to false. We can't manage anything inside them.
+	unconnectableDatabases []string
+
 	errors []string
 }
 
 // ValidateConfig checks whether the given config is correct.
 func ValidateConfig(c *Config) error {
 	v := validator{
-		tombstonedRoles:     c.TombstonedRoles,
+		tombstonedRoles:     tombstonedRoleNames(c.TombstonedRoles),
 		definedRoles:        lo.Keys(c.Roles),
-		tombstonedDatabases: c.TombstonedDatabases,
-		definedDatabases:    c.Databases,
+		tombstonedDatabases: tombstonedDatabaseNames(c.TombstonedDatabases),
+		definedDatabases:    databaseNames(c.Databases),
 		tombstonedSchemas:   c.TombstonedSchemas,
-		definedSchemas:      c.Schemas,
+		definedSchemas:      schemaNames(c.Schemas),
 	}
 	for name, r := range c.Roles {
 		if lo.Contains(v.tombstonedRoles, name) {
 			v.addErrorf("Role %s is both tombstoned and defined", name)
 		}
+		if strings.EqualFold(name, publicRole) {
+			v.addErrorf("Role %s can't be defined, because PUBLIC is a reserved pseudo-role", name)
+		}
 		v.validateRole(name, r)
 	}
+	for _, t := range c.TombstonedRoles {
+		if t.ReassignTo != "" {
+			v.checkRole("tombstoned role "+t.Name, t.ReassignTo)
+		}
+	}
+	for _, name := range c.UnmanagedRoles {
+		if !c.ManageAllRoles {
+			v.addErrorf("Role %s is listed in unmanaged_roles, but manage_all_roles isn't enabled", name)
+		}
+		if _, found := c.Roles[name]; found {
+			v.addErrorf("Role %s is both unmanaged and defined", name)
+		}
+		if lo.Contains(v.tombstonedRoles, name) {
+			v.addErrorf("Role %s is both unmanaged and tombstoned", name)
+		}
+	}
+	v.validateUnmanagedPatterns("unmanaged_databases", "manage_all_databases", c.ManageAllDatabases, c.UnmanagedDatabases)
+	v.validateUnmanagedPatterns("unmanaged_schemas", "manage_all_schemas", c.ManageAllSchemas, c.UnmanagedSchemas)
 	v.validateDatabases(c.Databases)
 	v.validateSchemas(c.Schemas)
 	v.validatePrivileges("databases", c.DatabasePrivileges)
+	v.validatePrivileges("tablespaces", c.TablespacePrivileges)
 	v.validatePrivileges("schemas", c.SchemaPrivileges)
 	v.validatePrivileges("tables", c.TablePrivileges)
 	v.validatePrivileges("sequences", c.SequencePrivileges)
+	v.validatePrivileges("columns", c.ColumnPrivileges)
+	v.validateColumnTargets(c.ColumnPrivileges)
+	v.validatePrivileges("routines", c.RoutinePrivileges)
+	v.validateRoutineTargets(c.RoutinePrivileges)
+	v.validatePrivileges("foreignDataWrappers", c.ForeignDataWrapperPrivileges)
+	v.validatePrivileges("foreignServers", c.ForeignServerPrivileges)
+	v.validatePrivileges("largeObjects", c.LargeObjectPrivileges)
+	v.validateLargeObjectTargets(c.LargeObjectPrivileges)
+	v.validateDefaultPrivileges(c.DefaultPrivileges)
+	v.validateOwnership(c.Ownership)
 
 	switch len(v.errors) {
 	case 0:
@@ -63,15 +104,96 @@ func (v *validator) addErrorf(f string, args ...interface{}) {
 }
 
 func (v *validator) checkRole(source, name string) {
+	if strings.EqualFold(name, publicRole) {
+		v.addErrorf("%s: PUBLIC can't be used as a role here", source)
+	}
 	if lo.Contains(v.tombstonedRoles, name) {
 		v.addErrorf("%s: Role %s is tombstoned and shouldn't be used", source, name)
 	}
 }
 
+// checkGrantee is like checkRole, but also allows the PUBLIC pseudo-role.
+func (v *validator) checkGrantee(source, name string) {
+	if name == publicRole {
+		return
+	}
+	if strings.EqualFold(name, publicRole) {
+		v.addErrorf("%s: Role %s should be written as PUBLIC", source, name)
+		return
+	}
+	v.checkRole(source, name)
+}
+
+// checkTarget checks that the database (and unless databaseLevel is set, the schema) of the given target are managed by this config.
+func (v *validator) checkTarget(source, kind, tgt string, databaseLevel bool) {
+	db, remaining := splitObjectName(tgt)
+	if db == "" {
+		db = remaining
+		remaining = ""
+	}
+	if db != "" && !lo.Contains(v.definedDatabases, db) {
+		v.addErrorf("%s: %s specified for unmanaged database %q", source, kind, db)
+	}
+	if remaining != "" && lo.Contains(v.unconnectableDatabases, db) {
+		v.addErrorf("%s: %s specified in database %q, which doesn't allow connections", source, kind, db)
+	}
+	if remaining == "" || databaseLevel {
+		return
+	}
+	schema, remaining := splitObjectName(remaining)
+	if schema == "" {
+		schema = remaining
+	}
+	fullSchema := joinSchemaName(db, schema)
+	if schema != "" && !lo.Contains(v.definedSchemas, fullSchema) {
+		v.addErrorf("%s: %s specified for unmanaged schema %q", source, kind, fullSchema)
+	}
+}
+
+var settingNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.]*$`)
+
 func (v *validator) validateRole(name string, r RoleAttributes) {
+	for setting := range r.Settings {
+		if !settingNameRe.MatchString(setting) {
+			v.addErrorf("Role %s: invalid setting name %q", name, setting)
+		}
+	}
+	for database, settings := range r.DatabaseSettings {
+		if !lo.Contains(v.definedDatabases, database) {
+			v.addErrorf("Role %s: database_settings specified for unmanaged database %q", name, database)
+		}
+		for setting := range settings {
+			if !settingNameRe.MatchString(setting) {
+				v.addErrorf("Role %s: invalid setting name %q for database %s", name, setting, database)
+			}
+		}
+	}
+}
+
+func (v *validator) validateUnmanagedPatterns(field, flag string, enabled bool, patterns []string) {
+	if len(patterns) > 0 && !enabled {
+		v.addErrorf("%s is set, but %s isn't enabled", field, flag)
+	}
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			v.addErrorf("%s: invalid pattern %q: %v", field, p, err)
+		}
+	}
 }
 
-func (v *validator) validateDatabases(names []string) {
+func (v *validator) validateDatabases(dbs []DatabaseDefinition) {
+	names := databaseNames(dbs)
+	for _, d := range dbs {
+		if d.Owner != "" {
+			v.checkRole("database "+d.Name, d.Owner)
+		}
+		if d.ConnectionLimit != nil && *d.ConnectionLimit < -1 {
+			v.addErrorf("Database %s: connection_limit should be -1 (unlimited) or higher", d.Name)
+		}
+		if !d.GetAllowConnections() {
+			v.unconnectableDatabases = append(v.unconnectableDatabases, d.Name)
+		}
+	}
 	for _, n := range names {
 		if !safeCharactersRe.MatchString(n) {
 			v.addErrorf("Database %q would need its name escaped, which isn't properly supported by this tool yet", n)
@@ -87,8 +209,16 @@ func (v *validator) validateDatabases(names []string) {
 	}
 }
 
-func (v *validator) validateSchemas(names []string) {
-	// TODO: Implement
+func (v *validator) validateSchemas(schemas []SchemaDefinition) {
+	// TODO: Validate the names
+	for _, s := range schemas {
+		if s.Owner != "" {
+			v.checkRole("schema "+s.Name, s.Owner)
+		}
+		if db, _ := splitObjectName(s.Name); lo.Contains(v.unconnectableDatabases, db) {
+			v.addErrorf("Schema %s is in database %s, which doesn't allow connections", s.Name, db)
+		}
+	}
 }
 
 func (v *validator) validatePrivileges(what string, privs []GenericPrivilege) {
@@ -109,28 +239,116 @@ func (v *validator) validatePrivileges(what string, privs []GenericPrivilege) {
 			v.addErrorf("%s: privilege has invalid privileges %v for %s_privileges", src, unknown, what[:len(what)-1])
 		}
 		for _, tgt := range p.untypedTargets() {
-			db, remaining := splitObjectName(tgt)
-			if db == "" {
-				db = remaining
-				remaining = ""
+			if what == "tablespaces" {
+				// Tablespaces are global to the cluster.
+				break
+			}
+			v.checkTarget(src, "privilege", tgt, lo.Contains(databaseLevelObjects, what))
+		}
+		for _, r := range p.Roles {
+			v.checkGrantee(src, r)
+		}
+	}
+}
+
+func (v *validator) validateColumnTargets(privs []GenericPrivilege) {
+	for i, p := range privs {
+		for _, tgt := range p.Columns {
+			if _, columns := splitColumnName(tgt); len(columns) == 0 || lo.Contains(columns, "") {
+				v.addErrorf("column_privilege[%d]: target %q should be in the format database.schema.table.(column1, column2)", i+1, tgt)
 			}
-			if db != "" && !lo.Contains(v.definedDatabases, db) {
-				v.addErrorf("%s: privilege specified for unmanaged database %q", src, db)
+		}
+	}
+}
+
+func (v *validator) validateRoutineTargets(privs []GenericPrivilege) {
+	for i, p := range privs {
+		for _, tgt := range p.Routines {
+			if !isRoutineTarget(tgt) {
+				v.addErrorf("routine_privilege[%d]: target %q should be in the format database.schema.routine(argtype1, argtype2) or database.schema.*", i+1, tgt)
 			}
-			if remaining == "" {
+		}
+	}
+}
+
+// isRoutineTarget returns whether tgt is in the format database.schema.routine(argtype1, argtype2) or database.schema.*.
+func isRoutineTarget(tgt string) bool {
+	return strings.HasSuffix(tgt, ".*") || strings.Contains(tgt, "(") && strings.HasSuffix(tgt, ")")
+}
+
+func (v *validator) validateLargeObjectTargets(privs []GenericPrivilege) {
+	for i, p := range privs {
+		src := fmt.Sprintf("large_object_privilege[%d]", i+1)
+		for _, tgt := range p.LargeObjects {
+			_, oid := splitObjectName(tgt)
+			if m := largeObjectsOwnedByRe.FindStringSubmatch(oid); m != nil {
+				v.checkRole(src, m[1])
 				continue
 			}
-			schema, remaining := splitObjectName(remaining)
-			if schema == "" {
-				schema = remaining
+			if _, err := strconv.ParseUint(oid, 10, 32); err != nil {
+				v.addErrorf("%s: target %q should be in the format database.oid or database.owned_by(role)", src, tgt)
+			}
+		}
+	}
+}
+
+func (v *validator) validateDefaultPrivileges(privs []DefaultPrivilege) {
+	for i, p := range privs {
+		src := fmt.Sprintf("default_privilege[%d]", i+1)
+		what, ok := defaultPrivilegeTypes[p.ObjectType]
+		if !ok {
+			v.addErrorf("%s: object_type should be one of tables, sequences, functions, types or schemas; got %q", src, p.ObjectType)
+		} else if len(p.Privileges) == 1 && p.Privileges[0] == "ALL PRIVILEGES" {
+			// OK
+		} else if unknown := slicez.Diff(p.Privileges, validPrivileges[what]); len(unknown) > 0 {
+			v.addErrorf("%s: privilege has invalid privileges %v for %s", src, unknown, p.ObjectType)
+		}
+		if p.Owner == "" {
+			v.addErrorf("%s: owner is missing", src)
+		}
+		v.checkRole(src, p.Owner)
+		if !lo.Contains(v.definedDatabases, p.Database) {
+			v.addErrorf("%s: default privilege specified for unmanaged database %q", src, p.Database)
+		}
+		if p.Schema != "" {
+			if p.ObjectType == "schemas" {
+				v.addErrorf("%s: default privileges for schemas can't be limited to a schema", src)
 			}
-			fullSchema := joinSchemaName(db, schema)
-			if schema != "" && !lo.Contains(v.definedSchemas, fullSchema) {
-				v.addErrorf("%s: privilege specified for unmanaged schema %q", src, fullSchema)
+			if !lo.Contains(v.definedSchemas, p.Database+"."+p.Schema) {
+				v.addErrorf("%s: default privilege specified for unmanaged schema %q", src, p.Database+"."+p.Schema)
 			}
 		}
 		for _, r := range p.Roles {
-			v.checkRole(src, r)
+			v.checkGrantee(src, r)
+		}
+	}
+}
+
+func (v *validator) validateOwnership(ownership []Ownership) {
+	// listedIn is the index of the ownership entry that lists an object, keyed by its keyword and name.
+	listedIn := map[string]int{}
+	for i, o := range ownership {
+		src := fmt.Sprintf("ownership[%d]", i+1)
+		if o.Owner == "" {
+			v.addErrorf("%s: owner is missing", src)
+		}
+		v.checkRole(src, o.Owner)
+		objects := o.ownedObjects()
+		for _, kind := range []string{"TABLE", "SEQUENCE", "ROUTINE"} {
+			for _, tgt := range objects[kind] {
+				v.checkTarget(src, "ownership", tgt, false)
+				key := kind + " " + tgt
+				if j, found := listedIn[key]; !found {
+					listedIn[key] = i
+				} else if j != i {
+					v.addErrorf("%s: %s %q is already listed in ownership[%d]", src, strings.ToLower(kind), tgt, j+1)
+				}
+			}
+		}
+		for _, tgt := range o.Routines {
+			if !isRoutineTarget(tgt) {
+				v.addErrorf("%s: routine %q should be in the format database.schema.routine(argtype1, argtype2) or database.schema.*", src, tgt)
+			}
 		}
 	}
 }